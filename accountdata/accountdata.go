@@ -0,0 +1,392 @@
+// Package accountdata imports Spotify's account data export, the ZIP from
+// "Download your data" in the account privacy settings. Its listening
+// history and library, which the Web API doesn't provide, are normalized and
+// kept in the history directory of a backup.
+package accountdata
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"spotify-backup/export"
+	"spotify-backup/storage"
+)
+
+// Data is what was read from an export.
+type Data struct {
+	Plays   []storage.Play
+	Library *storage.Library // nil if the export has no YourLibrary.json
+	Files   []string         // the files used, by their path in the export
+}
+
+// Open opens an export, either the ZIP as downloaded or a directory it was
+// extracted to. Close the returned closer when done.
+func Open(name string) (fs.FS, func() error, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return os.DirFS(name), func() error { return nil }, nil
+	}
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	return z, z.Close, nil
+}
+
+// Read reads the streaming history and library files anywhere in fsys,
+// skipping the other files of the export.
+func Read(fsys fs.FS) (*Data, error) {
+	d := &Data{}
+	err := fs.WalkDir(fsys, ".", func(name string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		var read func([]byte) error
+		switch base := path.Base(name); {
+		case base == "YourLibrary.json":
+			read = func(b []byte) (err error) {
+				d.Library, err = parseLibrary(b)
+				return err
+			}
+		case isExtended(base):
+			read = func(b []byte) error {
+				plays, err := parseExtended(b)
+				d.Plays = append(d.Plays, plays...)
+				return err
+			}
+		case strings.HasPrefix(base, "StreamingHistory") && strings.HasSuffix(base, ".json"):
+			read = func(b []byte) error {
+				plays, err := parseAccountData(b)
+				d.Plays = append(d.Plays, plays...)
+				return err
+			}
+		default:
+			return nil
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if err := read(b); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		d.Files = append(d.Files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Files) == 0 {
+		return nil, errors.New("no streaming history or YourLibrary.json found; is this Spotify's account data export?")
+	}
+	return d, nil
+}
+
+// isExtended reports whether a file belongs to the extended streaming
+// history, named Streaming_History_Audio_2019-2021_0.json and the like, or
+// endsong_0.json in older exports.
+func isExtended(base string) bool {
+	if !strings.HasSuffix(base, ".json") {
+		return false
+	}
+	return strings.HasPrefix(base, "Streaming_History_") || strings.HasPrefix(base, "endsong")
+}
+
+// accountDataPlay is an entry of StreamingHistory*.json: minute precision
+// and names only.
+type accountDataPlay struct {
+	EndTime     string `json:"endTime"` // "2006-01-02 15:04", UTC
+	ArtistName  string `json:"artistName"`
+	TrackName   string `json:"trackName"`
+	PodcastName string `json:"podcastName"`
+	EpisodeName string `json:"episodeName"`
+	MsPlayed    int    `json:"msPlayed"`
+}
+
+func parseAccountData(b []byte) ([]storage.Play, error) {
+	var in []accountDataPlay
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	plays := make([]storage.Play, 0, len(in))
+	for _, p := range in {
+		t, err := time.Parse("2006-01-02 15:04", p.EndTime)
+		if err != nil {
+			return nil, fmt.Errorf("endTime: %w", err)
+		}
+		plays = append(plays, storage.Play{
+			PlayedAt: t,
+			MsPlayed: p.MsPlayed,
+			Track:    p.TrackName,
+			Artist:   p.ArtistName,
+			Episode:  p.EpisodeName,
+			Show:     p.PodcastName,
+			Source:   storage.SourceAccountData,
+		})
+	}
+	return plays, nil
+}
+
+// extendedPlay is an entry of the extended streaming history. The user
+// name, IP address and user agent in there are left out of the backup.
+type extendedPlay struct {
+	TS          string  `json:"ts"`
+	Platform    string  `json:"platform"`
+	MsPlayed    int     `json:"ms_played"`
+	ConnCountry string  `json:"conn_country"`
+	Track       *string `json:"master_metadata_track_name"`
+	Artist      *string `json:"master_metadata_album_artist_name"`
+	Album       *string `json:"master_metadata_album_album_name"`
+	TrackURI    *string `json:"spotify_track_uri"`
+	Episode     *string `json:"episode_name"`
+	Show        *string `json:"episode_show_name"`
+	EpisodeURI  *string `json:"spotify_episode_uri"`
+	ReasonStart string  `json:"reason_start"`
+	ReasonEnd   string  `json:"reason_end"`
+	Shuffle     *bool   `json:"shuffle"`
+	Skipped     *bool   `json:"skipped"`
+	Offline     *bool   `json:"offline"`
+}
+
+func parseExtended(b []byte) ([]storage.Play, error) {
+	var in []extendedPlay
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	plays := make([]storage.Play, 0, len(in))
+	for _, p := range in {
+		t, err := time.Parse(time.RFC3339, p.TS)
+		if err != nil {
+			return nil, fmt.Errorf("ts: %w", err)
+		}
+		plays = append(plays, storage.Play{
+			PlayedAt:    t.UTC(),
+			MsPlayed:    p.MsPlayed,
+			Track:       str(p.Track),
+			Artist:      str(p.Artist),
+			Album:       str(p.Album),
+			TrackURI:    str(p.TrackURI),
+			Episode:     str(p.Episode),
+			Show:        str(p.Show),
+			EpisodeURI:  str(p.EpisodeURI),
+			Platform:    p.Platform,
+			Country:     p.ConnCountry,
+			ReasonStart: p.ReasonStart,
+			ReasonEnd:   p.ReasonEnd,
+			Shuffle:     p.Shuffle,
+			Skipped:     p.Skipped,
+			Offline:     p.Offline,
+			Source:      storage.SourceExtended,
+		})
+	}
+	return plays, nil
+}
+
+// yourLibrary is YourLibrary.json. Tracks and albums carry the names of
+// their artist and album; shows their publisher; episodes their show.
+type yourLibrary struct {
+	Tracks []struct {
+		Artist string `json:"artist"`
+		Album  string `json:"album"`
+		Track  string `json:"track"`
+		URI    string `json:"uri"`
+	} `json:"tracks"`
+	Albums []struct {
+		Artist string `json:"artist"`
+		Album  string `json:"album"`
+		URI    string `json:"uri"`
+	} `json:"albums"`
+	Artists []struct {
+		Name string `json:"name"`
+		URI  string `json:"uri"`
+	} `json:"artists"`
+	Shows []struct {
+		Name      string `json:"name"`
+		Publisher string `json:"publisher"`
+		URI       string `json:"uri"`
+	} `json:"shows"`
+	Episodes []struct {
+		Name string `json:"name"`
+		Show string `json:"show"`
+		URI  string `json:"uri"`
+	} `json:"episodes"`
+	BannedTracks []struct {
+		Artist string `json:"artist"`
+		Album  string `json:"album"`
+		Track  string `json:"track"`
+		URI    string `json:"uri"`
+	} `json:"bannedTracks"`
+	BannedArtists []struct {
+		Name string `json:"name"`
+		URI  string `json:"uri"`
+	} `json:"bannedArtists"`
+	Other []map[string]any `json:"other"`
+}
+
+func parseLibrary(b []byte) (*storage.Library, error) {
+	var in yourLibrary
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	l := &storage.Library{SchemaVersion: storage.HistorySchemaVersion, Other: in.Other}
+	for _, t := range in.Tracks {
+		l.Tracks = append(l.Tracks, storage.LibraryItem{Name: t.Track, Artist: t.Artist, Album: t.Album, URI: t.URI})
+	}
+	for _, a := range in.Albums {
+		l.Albums = append(l.Albums, storage.LibraryItem{Name: a.Album, Artist: a.Artist, URI: a.URI})
+	}
+	for _, a := range in.Artists {
+		l.Artists = append(l.Artists, storage.LibraryItem{Name: a.Name, URI: a.URI})
+	}
+	for _, s := range in.Shows {
+		l.Shows = append(l.Shows, storage.LibraryItem{Name: s.Name, Publisher: s.Publisher, URI: s.URI})
+	}
+	for _, e := range in.Episodes {
+		l.Episodes = append(l.Episodes, storage.LibraryItem{Name: e.Name, Show: e.Show, URI: e.URI})
+	}
+	for _, t := range in.BannedTracks {
+		l.BannedTracks = append(l.BannedTracks, storage.LibraryItem{Name: t.Track, Artist: t.Artist, Album: t.Album, URI: t.URI})
+	}
+	for _, a := range in.BannedArtists {
+		l.BannedArtists = append(l.BannedArtists, storage.LibraryItem{Name: a.Name, URI: a.URI})
+	}
+	return l, nil
+}
+
+// playKey identifies a play across exports and formats. Account data has
+// minute precision, so plays are compared to the minute; a key can stand
+// for several plays, e.g. a short track repeated within a minute.
+type playKey struct {
+	minute   int64
+	msPlayed int
+	name     string
+}
+
+func keyOf(p storage.Play) playKey {
+	name := p.Track
+	if name == "" {
+		name = p.Episode
+	}
+	return playKey{p.PlayedAt.Unix() / 60, p.MsPlayed, name}
+}
+
+// Merge adds the plays in add to those in have, skipping plays already
+// known, and returns them sorted by time with the number added. Each known
+// play accounts for one play in add, so repeated plays with the same key are
+// all kept. The sources in add are merged one after the other, extended
+// first, so a play in both the account data and the extended history is
+// kept once, in the richer extended form.
+func Merge(have, add []storage.Play) ([]storage.Play, int) {
+	out := slices.Clone(have)
+	bySource := make(map[string][]storage.Play)
+	for _, p := range add {
+		bySource[p.Source] = append(bySource[p.Source], p)
+	}
+	sources := []string{storage.SourceExtended, storage.SourceAccountData}
+	for _, src := range slices.Sorted(maps.Keys(bySource)) {
+		if !slices.Contains(sources, src) {
+			sources = append(sources, src)
+		}
+	}
+
+	added := 0
+	for _, src := range sources {
+		// plays of this source only match plays known before it
+		known := make(map[playKey][]int, len(out))
+		for i, p := range out {
+			known[keyOf(p)] = append(known[keyOf(p)], i)
+		}
+		for _, p := range bySource[src] {
+			k := keyOf(p)
+			if idx := known[k]; len(idx) > 0 {
+				known[k] = idx[1:]
+				if i := idx[0]; out[i].Source == storage.SourceAccountData && p.Source == storage.SourceExtended {
+					out[i] = p
+				}
+				continue
+			}
+			out = append(out, p)
+			added++
+		}
+	}
+	slices.SortStableFunc(out, func(a, b storage.Play) int { return a.PlayedAt.Compare(b.PlayedAt) })
+	return out, added
+}
+
+// Result tells what an import changed in the backup directory.
+type Result struct {
+	Plays   int      // plays in the history after the import
+	Added   int      // plays that weren't known before
+	Library bool     // whether the library was replaced
+	Written []string // files written, relative to the backup directory
+}
+
+// Import merges d into the history kept in dir and replaces the library if
+// d has one. The history is also written by every exporter that supports it.
+// The manifest of an earlier backup run, if any, is updated.
+func Import(dir string, d *Data, exporters []export.Exporter) (*Result, error) {
+	h, err := storage.ReadHistory(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		h = &storage.History{}
+	} else if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	h.SchemaVersion = storage.HistorySchemaVersion
+	h.UpdatedAt = time.Now().UTC()
+	h.Plays, res.Added = Merge(h.Plays, d.Plays)
+	res.Plays = len(h.Plays)
+
+	// the canonical file first, whether or not json is among the formats
+	rel, err := export.JSON{}.ExportHistory(dir, h)
+	if err != nil {
+		return nil, err
+	}
+	res.Written = append(res.Written, rel)
+	for _, ex := range exporters {
+		hx, ok := ex.(export.HistoryExporter)
+		if !ok || ex.Name() == "json" {
+			continue
+		}
+		rel, err := hx.ExportHistory(dir, h)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", ex.Name(), err)
+		}
+		res.Written = append(res.Written, rel)
+	}
+
+	if d.Library != nil {
+		l := *d.Library
+		l.ImportedAt = time.Now().UTC()
+		rel := filepath.Join(storage.HistoryDir, storage.LibraryFile)
+		if err := storage.WriteJSONFile(filepath.Join(dir, rel), &l); err != nil {
+			return nil, err
+		}
+		res.Library = true
+		res.Written = append(res.Written, rel)
+	}
+
+	if err := storage.UpdateManifest(dir, res.Written); err != nil {
+		return nil, fmt.Errorf("update manifest: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,211 @@
+package accountdata
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"spotify-backup/export"
+	"spotify-backup/storage"
+)
+
+// historyExporter records the history it is given instead of writing it.
+type historyExporter struct{ plays int }
+
+func (*historyExporter) Name() string { return "test" }
+
+func (*historyExporter) Export(string, *storage.SavedPlaylist) (string, error) { return "", nil }
+
+func (x *historyExporter) ExportHistory(dir string, h *storage.History) (string, error) {
+	x.plays = len(h.Plays)
+	return "test/history", nil
+}
+
+// zipDir packs a directory the way Spotify delivers the export.
+func zipDir(t *testing.T, dir string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "my_spotify_data.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func readExport(t *testing.T, name string) *Data {
+	t.Helper()
+	fsys, closeExport, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeExport()
+	d, err := Read(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestImportZip(t *testing.T) {
+	d := readExport(t, zipDir(t, "../testdata/dataexport"))
+	if len(d.Files) != 4 {
+		t.Errorf("read %v, want both histories, the podcasts and the library", d.Files)
+	}
+
+	out := t.TempDir()
+	hx := &historyExporter{}
+	res, err := Import(out, d, []export.Exporter{export.JSON{}, hx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the play in both histories is kept once
+	if res.Plays != 5 || res.Added != 5 || !res.Library {
+		t.Errorf("result = %+v, want 5 plays and the library", res)
+	}
+	// the JSON history is written once, other formats get the merged plays
+	if hx.plays != 5 || len(res.Written) != 3 {
+		t.Errorf("exporter got %d plays, wrote %v; want 5 plays, history, export and library", hx.plays, res.Written)
+	}
+
+	h, err := storage.ReadHistory(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := h.Plays[0]
+	if first.Source != storage.SourceExtended || first.PlayedAt.Year() != 2023 || first.Skipped == nil || !*first.Skipped {
+		t.Errorf("first play = %+v, want the skipped one of 2023", first)
+	}
+	dup := h.Plays[1]
+	if dup.Track != "Feeling Good" || dup.Source != storage.SourceExtended || dup.TrackURI == "" || dup.Album == "" {
+		t.Errorf("play in both histories = %+v, want the extended one", dup)
+	}
+	if last := h.Plays[4]; last.Show != "Song Exploder" || last.Episode != "Feeling Good" || last.Track != "" {
+		t.Errorf("last play = %+v, want the podcast episode", last)
+	}
+
+	lib, err := storage.ReadLibrary(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Tracks) != 1 || lib.Tracks[0].Name != "Feeling Good" || len(lib.Albums) != 1 || len(lib.Shows) != 1 || len(lib.Artists) != 1 {
+		t.Errorf("library = %+v", lib)
+	}
+}
+
+func TestReimportSkipsKnownPlays(t *testing.T) {
+	out := t.TempDir()
+	// a manifest from an earlier backup run
+	m, err := storage.BuildManifest(out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteJSONFile(filepath.Join(out, storage.ManifestFile), m); err != nil {
+		t.Fatal(err)
+	}
+
+	d := readExport(t, "../testdata/dataexport")
+	if _, err := Import(out, d, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Import(out, d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Plays != 5 || res.Added != 0 {
+		t.Errorf("reimport = %+v, want nothing added", res)
+	}
+
+	m, err = storage.ReadManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 {
+		t.Errorf("manifest lists %v, want the history and library", m.Files)
+	}
+	if problems, err := storage.Verify(out, m); err != nil || len(problems) > 0 {
+		t.Errorf("verify after import: %v %v", problems, err)
+	}
+}
+
+func TestRepeatedPlaysAreKept(t *testing.T) {
+	// a short track played twice within a minute looks the same in account data
+	play := storage.Play{PlayedAt: time.Date(2024, 1, 2, 10, 15, 0, 0, time.UTC), MsPlayed: 25000, Track: "Intro", Artist: "The xx", Source: storage.SourceAccountData}
+	d := &Data{Plays: []storage.Play{play, play}}
+
+	out := t.TempDir()
+	res, err := Import(out, d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Plays != 2 || res.Added != 2 {
+		t.Errorf("import = %+v, want both plays", res)
+	}
+	if res, err = Import(out, d, nil); err != nil || res.Plays != 2 || res.Added != 0 {
+		t.Errorf("reimport = %+v, %v; want nothing added", res, err)
+	}
+
+	// the extended history of the same plays replaces both
+	ext := play
+	ext.Source, ext.TrackURI = storage.SourceExtended, "spotify:track:intro"
+	plays, added := Merge([]storage.Play{play, play}, []storage.Play{ext, ext, ext})
+	if len(plays) != 3 || added != 1 || plays[0].Source != storage.SourceExtended || plays[1].Source != storage.SourceExtended {
+		t.Errorf("merge = %d added, %+v; want the known plays upgraded and one added", added, plays)
+	}
+}
+
+func TestReadRejectsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.json"), []byte("{}"), 0o644)
+	if _, err := Read(os.DirFS(dir)); err == nil {
+		t.Error("no error for a directory without an export")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	d := readExport(t, "../testdata/dataexport")
+	plays, _ := Merge(nil, d.Plays)
+	st := Summarize(plays, 1)
+	if st.Plays != 5 || st.First.Year() != 2023 || st.Last.Day() != 3 {
+		t.Errorf("stats = %+v", st)
+	}
+	if len(st.TopArtists) != 1 || st.TopArtists[0].Name != "Miles Davis" {
+		t.Errorf("top artists = %+v, want Miles Davis by time played", st.TopArtists)
+	}
+	if len(st.TopTracks) != 1 || st.TopTracks[0].Name != "Feeling Good - Nina Simone" || st.TopTracks[0].Plays != 2 {
+		t.Errorf("top tracks = %+v, want Feeling Good by plays", st.TopTracks)
+	}
+	if len(st.TopShows) != 1 || st.TopShows[0].Name != "Song Exploder" {
+		t.Errorf("top shows = %+v", st.TopShows)
+	}
+}
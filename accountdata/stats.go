@@ -0,0 +1,85 @@
+package accountdata
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"spotify-backup/storage"
+)
+
+// Stats summarizes a listening history.
+type Stats struct {
+	Plays      int
+	First      time.Time
+	Last       time.Time
+	TimePlayed time.Duration
+	TopArtists []Count // by time played
+	TopTracks  []Count // by number of plays
+	TopShows   []Count // by time played
+}
+
+// Count is how often or how long something was listened to.
+type Count struct {
+	Name       string
+	Plays      int
+	TimePlayed time.Duration
+}
+
+// Summarize computes the stats of plays, keeping the top n of each list.
+func Summarize(plays []storage.Play, n int) Stats {
+	var st Stats
+	artists := make(map[string]*Count)
+	tracks := make(map[string]*Count)
+	shows := make(map[string]*Count)
+	add := func(m map[string]*Count, name string, d time.Duration) {
+		if name == "" {
+			return
+		}
+		c, ok := m[name]
+		if !ok {
+			c = &Count{Name: name}
+			m[name] = c
+		}
+		c.Plays++
+		c.TimePlayed += d
+	}
+	for _, p := range plays {
+		d := time.Duration(p.MsPlayed) * time.Millisecond
+		st.Plays++
+		st.TimePlayed += d
+		if st.First.IsZero() || p.PlayedAt.Before(st.First) {
+			st.First = p.PlayedAt
+		}
+		if p.PlayedAt.After(st.Last) {
+			st.Last = p.PlayedAt
+		}
+		add(artists, p.Artist, d)
+		if p.Track != "" {
+			add(tracks, p.Track+" - "+p.Artist, d)
+		}
+		add(shows, p.Show, d)
+	}
+	byTime := func(a, b Count) int {
+		return cmp.Or(cmp.Compare(b.TimePlayed, a.TimePlayed), cmp.Compare(a.Name, b.Name))
+	}
+	byPlays := func(a, b Count) int {
+		return cmp.Or(cmp.Compare(b.Plays, a.Plays), cmp.Compare(a.Name, b.Name))
+	}
+	st.TopArtists = top(artists, n, byTime)
+	st.TopTracks = top(tracks, n, byPlays)
+	st.TopShows = top(shows, n, byTime)
+	return st
+}
+
+func top(m map[string]*Count, n int, order func(a, b Count) int) []Count {
+	out := make([]Count, 0, len(m))
+	for _, c := range m {
+		out = append(out, *c)
+	}
+	slices.SortFunc(out, order)
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
@@ -0,0 +1,330 @@
+// Package auth implements the Spotify OAuth flows used by the CLI and keeps
+// the refresh token on disk.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"spotify-backup/spotify"
+)
+
+// Scopes are the permissions requested from the user.
+const Scopes = "playlist-read-private playlist-read-collaborative user-library-read"
+
+// RestoreScopes are requested by the restore command only, which needs to
+// create and follow playlists. They are not among Features, so tokens
+// authorized for backups alone are not reported as lacking anything.
+const RestoreScopes = Scopes + " playlist-modify-public playlist-modify-private"
+
+// Feature is something the tool does with the scopes it needs.
+type Feature struct {
+	Name   string
+	Scopes []string
+}
+
+// Features are what Scopes are requested for.
+var Features = []Feature{
+	{Name: "privatePlaylists", Scopes: []string{"playlist-read-private"}},
+	{Name: "collaborativePlaylists", Scopes: []string{"playlist-read-collaborative"}},
+	{Name: "library", Scopes: []string{"user-library-read"}},
+}
+
+// MissingScopes returns the scopes not among granted, by the name of the
+// feature needing them. It is empty if every feature is covered.
+func MissingScopes(granted []string) map[string][]string {
+	have := make(map[string]bool, len(granted))
+	for _, s := range granted {
+		have[s] = true
+	}
+	missing := make(map[string][]string)
+	for _, f := range Features {
+		for _, s := range f.Scopes {
+			if !have[s] {
+				missing[f.Name] = append(missing[f.Name], s)
+			}
+		}
+	}
+	return missing
+}
+
+// LoadRefreshToken reads the refresh token from the token file if present.
+func LoadRefreshToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// SaveRefreshToken persists the refresh token to the token file.
+func SaveRefreshToken(path, tok string) error {
+	tok = strings.TrimSpace(tok)
+	if tok == "" {
+		return errors.New("empty refresh token")
+	}
+	return os.WriteFile(path, []byte(tok+"\n"), 0o600)
+}
+
+// DeleteRefreshToken removes the token file; a missing file is no error.
+func DeleteRefreshToken(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// CallbackPath is where web mode receives the redirect from Spotify.
+const CallbackPath = "/api/auth/callback"
+
+// ParseCallback returns the code and state Spotify redirected back with,
+// or the error it reported, e.g. access_denied when the user cancelled.
+func ParseCallback(q url.Values) (code, state string, err error) {
+	if e := q.Get("error"); e != "" {
+		return "", "", fmt.Errorf("spotify: %s", e)
+	}
+	if code = q.Get("code"); code == "" {
+		return "", "", errors.New("no authorization code received")
+	}
+	return code, q.Get("state"), nil
+}
+
+// CallbackHandler handles the redirect back from Spotify to the redirect
+// URI, in CLI and web mode. It passes the code and state to exchange and
+// tells the user in the browser how the authorization went.
+func CallbackHandler(exchange func(ctx context.Context, code, state string) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		code, state, err := ParseCallback(r.URL.Query())
+		if err == nil {
+			err = exchange(r.Context(), code, state)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<html><body><h1>Error</h1><p>%s</p><p>Please start the authorization again.</p></body></html>", html.EscapeString(err.Error()))
+			return
+		}
+		fmt.Fprint(w, "<html><body><h1>✓ Authorization successful!</h1><p>You can close this window and return to the application.</p></body></html>")
+	})
+}
+
+// Interactive implements the authorization code flow with a local server
+// receiving the callback on the port and path of redirectURI, asking for
+// scopes, such as Scopes. It gives up when ctx is cancelled.
+func Interactive(ctx context.Context, client *spotify.Client, clientID, clientSecret, redirectURI, scopes string) (accessToken, refreshToken string, err error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid redirect URI: %w", err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "8888"
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	state, err := randomState()
+	if err != nil {
+		return "", "", err
+	}
+	authURL := client.AuthorizeURL(clientID, redirectURI, scopes, state)
+
+	tokChan := make(chan *spotify.Token, 1)
+	errChan := make(chan error, 1)
+
+	// A mux of its own, so the flow can run more than once in a process
+	mux := http.NewServeMux()
+	mux.Handle(path, CallbackHandler(func(ctx context.Context, code, got string) error {
+		if got != state {
+			return errors.New("unknown or expired authorization request")
+		}
+		tok, err := client.ExchangeCode(ctx, clientID, clientSecret, code, redirectURI)
+		if err != nil {
+			return err
+		}
+		select {
+		case tokChan <- tok:
+		default: // a second callback
+		}
+		return nil
+	}))
+	// a denied authorization ends the flow instead of waiting for the timeout
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := ParseCallback(r.URL.Query()); err != nil && r.URL.Path == path {
+			select {
+			case errChan <- err:
+			default:
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+	// listen before opening the browser, so the callback can't come too early
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return "", "", fmt.Errorf("listen for the callback: %w", err)
+	}
+	srv := &http.Server{Handler: handler}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("server error: %w", err)
+		}
+	}()
+	// Shutdown server, also when giving up
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("starting Spotify authorization, opening browser", "callback_port", port, "callback_path", path)
+
+	// Open browser automatically; the URL is a prompt for the user, not a log line
+	if err := openBrowser(authURL); err != nil {
+		slog.Debug("failed to open browser", "err", err)
+		fmt.Println("\nCouldn't open browser automatically. Please open this URL manually:")
+		fmt.Printf("\n   %s\n\n", authURL)
+	}
+
+	slog.Info("waiting for authorization")
+
+	select {
+	case tok := <-tokChan:
+		slog.Info("authorization successful")
+		return tok.AccessToken, tok.RefreshToken, nil
+	case err := <-errChan:
+		return "", "", err
+	case <-time.After(5 * time.Minute):
+		return "", "", errors.New("timeout waiting for authorization")
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
+// Headless implements the authorization code flow without a browser or a
+// listener on this machine: the authorize URL, asking for scopes, is written to out, the user
+// opens it anywhere and pastes back the URL they were redirected to, or
+// just its code, which is read from in. The redirect doesn't have to reach
+// anything. It gives up when ctx is cancelled, but the line is read in a
+// goroutine of its own that stays blocked on in and swallows the next line
+// arriving there, so don't read from in again after a cancelled flow.
+func Headless(ctx context.Context, client *spotify.Client, clientID, clientSecret, redirectURI, scopes string, in io.Reader, out io.Writer) (accessToken, refreshToken string, err error) {
+	state, err := randomState()
+	if err != nil {
+		return "", "", err
+	}
+	authURL := client.AuthorizeURL(clientID, redirectURI, scopes, state)
+	fmt.Fprintf(out, "\nOpen this URL in a browser on any machine and allow access:\n\n   %s\n\n", authURL)
+	fmt.Fprintln(out, "The browser is then sent to", redirectURI+"?code=...; it doesn't matter if that page fails to load.")
+	fmt.Fprint(out, "Paste the whole URL from the address bar, or just the code: ")
+
+	lines := make(chan string, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		sc := bufio.NewScanner(in)
+		if sc.Scan() {
+			lines <- sc.Text()
+			return
+		}
+		if err := sc.Err(); err != nil {
+			errChan <- err
+			return
+		}
+		errChan <- errors.New("no authorization code entered")
+	}()
+
+	var line string
+	select {
+	case line = <-lines:
+	case err := <-errChan:
+		return "", "", err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+	code, err := ParseRedirect(line, state)
+	if err != nil {
+		return "", "", err
+	}
+	tok, err := client.ExchangeCode(ctx, clientID, clientSecret, code, redirectURI)
+	if err != nil {
+		return "", "", err
+	}
+	slog.Info("authorization successful")
+	return tok.AccessToken, tok.RefreshToken, nil
+}
+
+// ParseRedirect returns the authorization code in input, either the URL
+// Spotify redirected to or a bare code. A URL must carry state.
+func ParseRedirect(input, state string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", errors.New("no authorization code entered")
+	}
+	if !strings.Contains(input, "?") {
+		if strings.ContainsAny(input, " /:") {
+			return "", errors.New("want the redirected URL or the code")
+		}
+		return input, nil
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	code, got, err := ParseCallback(u.Query())
+	if err != nil {
+		return "", err
+	}
+	if got != state {
+		return "", errors.New("the URL is from another authorization request")
+	}
+	return code, nil
+}
+
+// randomState returns a value for the state parameter, tying the callback
+// to the authorization started.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// openBrowser is OpenBrowser, replaced in tests.
+var openBrowser = OpenBrowser
+
+// OpenBrowser opens the specified URL in the default browser
+func OpenBrowser(url string) error {
+	var cmd string
+	var args []string
+
+	switch runtime.GOOS {
+	case "windows":
+		cmd = "cmd"
+		args = []string{"/c", "start"}
+	case "darwin":
+		cmd = "open"
+	default: // "linux", "freebsd", "openbsd", "netbsd"
+		cmd = "xdg-open"
+	}
+	args = append(args, url)
+	return exec.Command(cmd, args...).Start()
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"spotify-backup/spotifytest"
+)
+
+func newFakeSpotify(t *testing.T) *spotifytest.Server {
+	t.Helper()
+	fx, err := spotifytest.LoadFixture("../testdata/account.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := spotifytest.NewServer(fx)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseRedirect(t *testing.T) {
+	tests := []struct {
+		name, input string
+		code        string // empty if an error is expected
+		err         string
+	}{
+		{name: "bare code", input: "  AQBcode-123\n", code: "AQBcode-123"},
+		{name: "redirect URL", input: "http://127.0.0.1:8888/callback?code=AQBcode&state=s1", code: "AQBcode"},
+		{name: "state mismatch", input: "http://127.0.0.1:8888/callback?code=AQBcode&state=other", err: "another authorization request"},
+		{name: "URL without state", input: "http://127.0.0.1:8888/callback?code=AQBcode", err: "another authorization request"},
+		{name: "access denied", input: "http://127.0.0.1:8888/callback?error=access_denied&state=s1", err: "access_denied"},
+		{name: "URL without code", input: "http://127.0.0.1:8888/callback?state=s1", err: "no authorization code"},
+		{name: "empty", input: " \n", err: "no authorization code"},
+		{name: "garbage", input: "not a code", err: "want the redirected URL or the code"},
+		{name: "URL without query", input: "http://127.0.0.1:8888/callback", err: "want the redirected URL or the code"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := ParseRedirect(tc.input, "s1")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("ParseRedirect(%q) = %q, %v, want error containing %q", tc.input, code, err, tc.err)
+				}
+				return
+			}
+			if err != nil || code != tc.code {
+				t.Errorf("ParseRedirect(%q) = %q, %v, want %q", tc.input, code, err, tc.code)
+			}
+		})
+	}
+}
+
+func TestHeadless(t *testing.T) {
+	fake := newFakeSpotify(t)
+	client := fake.SpotifyClient()
+	const redirectURI = "http://127.0.0.1:8888/callback"
+
+	// authorize like the user would in a browser elsewhere, to get a code
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(client.AuthorizeURL(fake.ClientID, redirectURI, Scopes, "elsewhere"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || loc.Query().Get("code") == "" {
+		t.Fatalf("authorize redirect = %q", resp.Header.Get("Location"))
+	}
+
+	var out bytes.Buffer
+	in := strings.NewReader(loc.Query().Get("code") + "\n")
+	access, refresh, err := Headless(context.Background(), client, fake.ClientID, fake.ClientSecret, redirectURI, Scopes, in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access != fake.AccessToken || refresh != fake.RefreshToken {
+		t.Errorf("tokens = %q, %q, want the fake's", access, refresh)
+	}
+	if !strings.Contains(out.String(), fake.URL+"/authorize?") {
+		t.Errorf("output doesn't show the authorize URL:\n%s", out.String())
+	}
+
+	t.Run("no input", func(t *testing.T) {
+		_, _, err := Headless(context.Background(), client, fake.ClientID, fake.ClientSecret, redirectURI, Scopes, strings.NewReader(""), &out)
+		if err == nil || !strings.Contains(err.Error(), "no authorization code") {
+			t.Errorf("err = %v, want no authorization code", err)
+		}
+	})
+	t.Run("used code", func(t *testing.T) {
+		in := strings.NewReader(loc.Query().Get("code") + "\n")
+		if _, _, err := Headless(context.Background(), client, fake.ClientID, fake.ClientSecret, redirectURI, Scopes, in, &out); err == nil {
+			t.Error("a code was exchanged twice")
+		}
+	})
+}
+
+// fakeBrowser replaces openBrowser, handing the URLs to open to the test.
+func fakeBrowser(t *testing.T) <-chan string {
+	urls := make(chan string, 1)
+	prev := openBrowser
+	openBrowser = func(u string) error { urls <- u; return nil }
+	t.Cleanup(func() { openBrowser = prev })
+	return urls
+}
+
+// localRedirectURI returns a redirect URI on a free local port.
+func localRedirectURI(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return fmt.Sprintf("http://127.0.0.1:%d/callback", ln.Addr().(*net.TCPAddr).Port)
+}
+
+type tokens struct {
+	access, refresh string
+	err             error
+}
+
+// startInteractive runs Interactive in the background and returns the
+// authorize URL it opened and where its result arrives.
+func startInteractive(t *testing.T, fake *spotifytest.Server, urls <-chan string, redirectURI string) (string, <-chan tokens) {
+	t.Helper()
+	done := make(chan tokens, 1)
+	go func() {
+		access, refresh, err := Interactive(context.Background(), fake.SpotifyClient(), fake.ClientID, fake.ClientSecret, redirectURI, Scopes)
+		done <- tokens{access, refresh, err}
+	}()
+	select {
+	case u := <-urls:
+		return u, done
+	case res := <-done:
+		t.Fatalf("Interactive returned before opening the browser: %v", res.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the browser wasn't opened")
+	}
+	return "", nil
+}
+
+func waitTokens(t *testing.T, done <-chan tokens) tokens {
+	t.Helper()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("Interactive didn't return")
+		return tokens{}
+	}
+}
+
+func TestInteractiveRunsTwice(t *testing.T) {
+	fake := newFakeSpotify(t)
+	urls := fakeBrowser(t)
+	redirectURI := localRedirectURI(t)
+
+	// the callback server of the first run must be gone for the second
+	for i := range 2 {
+		authURL, done := startInteractive(t, fake, urls, redirectURI)
+		resp, err := http.Get(authURL) // follows the redirect to the callback
+		if err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("run %d: callback status = %d", i+1, resp.StatusCode)
+		}
+		res := waitTokens(t, done)
+		if res.err != nil || res.access != fake.AccessToken || res.refresh != fake.RefreshToken {
+			t.Errorf("run %d: Interactive = %q, %q, %v, want the fake's tokens", i+1, res.access, res.refresh, res.err)
+		}
+	}
+}
+
+func TestInteractiveRejectsWrongState(t *testing.T) {
+	fake := newFakeSpotify(t)
+	urls := fakeBrowser(t)
+	redirectURI := localRedirectURI(t)
+
+	authURL, done := startInteractive(t, fake, urls, redirectURI)
+	resp, err := http.Get(redirectURI + "?code=forged&state=wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "unknown or expired") {
+		t.Errorf("callback with a wrong state = %d %s, want 400", resp.StatusCode, body)
+	}
+	for _, r := range fake.Requests() {
+		if r == "POST /api/token" {
+			t.Error("the code of a callback with a wrong state was exchanged")
+		}
+	}
+
+	// the flow is still waiting for the real callback
+	resp, err = http.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if res := waitTokens(t, done); res.err != nil || res.access != fake.AccessToken {
+		t.Errorf("Interactive = %q, %v, want the fake's access token", res.access, res.err)
+	}
+}
@@ -0,0 +1,345 @@
+// Package backup is the backup engine: it selects playlists, fetches their
+// tracks and writes them, their cover images and the index to disk.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"spotify-backup/export"
+	"spotify-backup/metrics"
+	"spotify-backup/spotify"
+	"spotify-backup/storage"
+)
+
+// Options configures a backup run. Client, AccessToken and OutDir are required.
+type Options struct {
+	Client      *spotify.Client
+	AccessToken string
+	OutDir      string
+	PublicOnly  bool // app-only token: skip the user's own playlists
+	AllImages   bool // download every cover size, not just the largest
+	Followers   bool // fetch follower counts of library playlists, one request each
+	Filter      *Filter
+	ExtraIDs    []string // playlists backed up regardless of Filter
+	// Exporters run in addition to the JSON playlist files the index
+	// refers to, which are always written.
+	Exporters []export.Exporter
+	// Resume continues an interrupted run from its journal: playlists
+	// that were finished and haven't changed since are not fetched again.
+	Resume bool
+	// ToolVersion is recorded in the manifest.
+	ToolVersion string
+	// Logger receives progress and warnings; nil means slog.Default().
+	Logger *slog.Logger
+}
+
+// Result summarizes a finished run.
+type Result struct {
+	Index      []storage.IndexEntry
+	Incomplete bool // the run was cancelled and the index is partial
+	Report     *Report
+}
+
+// Backup writes the selected playlists, their images and the index to
+// opts.OutDir. Failures for single playlists are reported and skipped.
+//
+// When ctx is cancelled the playlist being written is finished, the index of
+// everything written so far is saved next to an IncompleteFile marker and
+// the context error is returned along with the partial Result. Progress is
+// journaled as the run goes, so a later run with opts.Resume picks up where
+// this one stopped.
+//
+// The returned Result is never nil: even when the run fails outright its
+// Report says why, and the report is saved as storage.ReportFile.
+func Backup(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	log := opts.Logger
+	rep := &Report{ToolVersion: opts.ToolVersion, StartedAt: time.Now().UTC(), log: log}
+	client := *opts.Client
+	onRetry := client.OnRetry
+	client.OnRetry = func(urlStr string, wait time.Duration) {
+		log.Info("rate limited, retrying", "url", urlStr, "wait", wait)
+		rep.retry(urlStr, wait)
+		if onRetry != nil {
+			onRetry(urlStr, wait)
+		}
+	}
+	opts.Client = &client
+
+	res, err := run(ctx, opts, rep)
+	rep.finish(res, err)
+	metrics.BackupRuns.WithLabelValues(rep.Outcome).Inc()
+	metrics.BackupDuration.Observe(rep.FinishedAt.Sub(rep.StartedAt).Seconds())
+	if rep.OK() {
+		metrics.LastSuccess.Set(float64(rep.FinishedAt.Unix()))
+	}
+	if res == nil {
+		res = &Result{}
+	}
+	res.Report = rep
+	if err := storage.WriteJSONFile(filepath.Join(opts.OutDir, storage.ReportFile), rep); err != nil {
+		log.Warn("failed to write report", "file", storage.ReportFile, "err", err)
+	}
+	return res, err
+}
+
+func run(ctx context.Context, opts Options, rep *Report) (*Result, error) {
+	client, accessToken, filter, log := opts.Client, opts.AccessToken, opts.Filter, opts.Logger
+	if filter == nil {
+		filter = &Filter{Scope: "all"}
+	}
+	if err := os.MkdirAll(opts.OutDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create outdir: %w", err)
+	}
+	// the previous manifest, if any, to report what changed
+	prev, _ := storage.ReadManifest(opts.OutDir)
+
+	// an app token has no user, so only the listed playlists can be fetched
+	var userID string
+	var all []spotify.Playlist
+	if !opts.PublicOnly {
+		var err error
+		userID, err = client.FetchCurrentUserID(ctx, accessToken)
+		if err != nil {
+			return nil, fmt.Errorf("fetch current user: %w", err)
+		}
+		all, err = client.FetchAllPlaylists(ctx, accessToken)
+		if err != nil {
+			return nil, fmt.Errorf("fetch playlists: %w", err)
+		}
+	}
+	playlists := make([]spotify.Playlist, 0, len(all)+len(opts.ExtraIDs))
+	seen := make(map[string]bool, len(all)+len(opts.ExtraIDs))
+	// only playlists in the user's library can have been followed
+	inLibrary := make(map[string]bool, len(all))
+	for _, p := range all {
+		inLibrary[p.ID] = true
+		if filter.Match(p, userID) {
+			playlists = append(playlists, p)
+			seen[p.ID] = true
+		}
+	}
+	if !opts.PublicOnly {
+		log.Info("found playlists", "count", len(all), "selected", len(playlists))
+	}
+
+	// explicitly requested playlists bypass the filter
+	for _, id := range opts.ExtraIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		p, err := client.FetchPlaylist(ctx, accessToken, id)
+		if err != nil {
+			rep.fail(id, "", StagePlaylist, err)
+			continue
+		}
+		playlists = append(playlists, *p)
+	}
+	if len(opts.ExtraIDs) > 0 {
+		log.Info("added listed playlists", "total", len(playlists))
+	}
+
+	rep.Selected = len(playlists)
+
+	imagesDir := filepath.Join(opts.OutDir, storage.ImagesDir)
+	_ = os.MkdirAll(imagesDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(opts.OutDir, storage.PlaylistsDir), 0o755)
+
+	index := make([]storage.IndexEntry, 0, len(playlists))
+
+	j, err := openJournal(opts.OutDir, opts.Resume)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	defer j.close()
+
+	processed := 0
+	for i, p := range playlists {
+		if ctx.Err() != nil {
+			break
+		}
+		if entry, ok := j.completed(opts.OutDir, p); ok {
+			log.Info("playlist already backed up", "playlist", p.ID, "name", p.Name, "n", i+1, "of", len(playlists))
+			index = append(index, entry)
+			processed++
+			continue
+		}
+		log.Info("downloading playlist", "playlist", p.ID, "name", p.Name, "n", i+1, "of", len(playlists))
+		tracks, err := fetchTracks(ctx, log, client, accessToken, j, p)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			rep.fail(p.ID, p.Name, StageTracks, err)
+			processed++
+			continue
+		}
+		processed++
+		// the tracks are in hand, so finish this playlist even if cancelled
+		ctx := context.WithoutCancel(ctx)
+		sp := storage.SavedPlaylist{
+			SchemaVersion: storage.SchemaVersion,
+			ID:            p.ID,
+			Name:          p.Name,
+			Description:   p.Description,
+			Owner:         p.Owner.DisplayName,
+			OwnerID:       p.Owner.ID,
+			Public:        p.Public,
+			Collaborative: p.Collaborative,
+			SnapshotID:    p.SnapshotID,
+			Images:        p.Images,
+			TracksTotal:   p.Tracks.Total,
+			Tracks:        tracks,
+			SourceURL:     fmt.Sprintf("https://open.spotify.com/playlist/%s", p.ID),
+		}
+		// followers are only part of the full playlist object, which
+		// listed playlists are fetched as
+		if p.Followers != nil {
+			sp.Followers = p.Followers.Total
+		} else if opts.Followers {
+			followers, err := client.FetchPlaylistFollowers(ctx, accessToken, p.ID)
+			if err != nil {
+				rep.warn(p.ID, p.Name, StageFollowers, err)
+			}
+			sp.Followers = followers
+		}
+		largest, hasImage := spotify.LargestImage(p.Images)
+		if hasImage {
+			sp.Image = largest.URL
+		}
+
+		file, err := export.JSON{}.Export(opts.OutDir, &sp)
+		if err != nil {
+			rep.fail(p.ID, p.Name, StageWrite, err)
+			continue
+		}
+		rep.wrote(filepath.Join(opts.OutDir, file))
+		for _, ex := range opts.Exporters {
+			if rel, err := ex.Export(opts.OutDir, &sp); err != nil {
+				rep.fail(p.ID, p.Name, StageExport, fmt.Errorf("%s: %w", ex.Name(), err))
+			} else {
+				rep.wrote(filepath.Join(opts.OutDir, rel))
+			}
+		}
+
+		// optional: download the other image sizes
+		if opts.AllImages {
+			for i, img := range p.Images {
+				if img.URL == "" || img.URL == largest.URL {
+					continue
+				}
+				size := fmt.Sprintf("%dx%d", img.Width, img.Height)
+				if img.Width == 0 || img.Height == 0 {
+					size = fmt.Sprintf("%d", i)
+				}
+				imgName := storage.SafeFilename(fmt.Sprintf("playlist-%s-%s%s", p.ID, size, storage.ImageExt(img.URL)))
+				imgPath := filepath.Join(imagesDir, imgName)
+				if err := client.DownloadFile(ctx, img.URL, imgPath); err != nil {
+					rep.fail(p.ID, p.Name, StageImage, err)
+				} else {
+					rep.wrote(imgPath)
+				}
+			}
+		}
+
+		entry := storage.IndexEntry{
+			ID:   p.ID,
+			Name: p.Name,
+			File: file,
+			// followed playlists should be re-followed on restore, not
+			// recreated; without a user nothing is followed
+			Followed: userID != "" && inLibrary[p.ID] && p.Owner.ID != userID,
+		}
+
+		// optional: download playlist image
+		if hasImage {
+			imgName := storage.SafeFilename(fmt.Sprintf("playlist-%s%s", p.ID, storage.ImageExt(sp.Image)))
+			imgPath := filepath.Join(imagesDir, imgName)
+			if err := client.DownloadFile(ctx, sp.Image, imgPath); err != nil {
+				rep.fail(p.ID, p.Name, StageImage, err)
+			} else {
+				entry.ImageFile = filepath.Join(storage.ImagesDir, imgName)
+				rep.wrote(imgPath)
+			}
+		}
+		index = append(index, entry)
+		metrics.Playlists.Inc()
+		metrics.Tracks.Add(float64(len(tracks)))
+		if err := j.markDone(p, entry); err != nil {
+			log.Warn("failed to journal playlist", "playlist", p.ID, "err", err)
+		}
+	}
+
+	// write top-level index
+	indexPath := filepath.Join(opts.OutDir, storage.IndexFile)
+	if err := storage.WriteJSONFile(indexPath, index); err != nil {
+		log.Warn("failed to write index", "err", err)
+	} else {
+		rep.wrote(indexPath)
+	}
+
+	rep.BackedUp = len(index)
+	res := &Result{Index: index, Incomplete: ctx.Err() != nil}
+	markerPath := filepath.Join(opts.OutDir, storage.IncompleteFile)
+	if !res.Incomplete {
+		os.Remove(markerPath)
+		if err := j.remove(); err != nil {
+			log.Warn("failed to remove journal", "err", err)
+		}
+	} else {
+		marker := storage.Incomplete{
+			Reason:    ctx.Err().Error(),
+			Time:      time.Now().UTC(),
+			Selected:  len(playlists),
+			Processed: processed,
+		}
+		if err := storage.WriteJSONFile(markerPath, marker); err != nil {
+			log.Warn("failed to write incomplete marker", "file", storage.IncompleteFile, "err", err)
+		}
+	}
+	writeManifest(opts, rep, prev, index, !res.Incomplete)
+
+	if res.Incomplete {
+		return res, fmt.Errorf("backup interrupted after %d of %d playlists: %w", processed, len(playlists), ctx.Err())
+	}
+	return res, nil
+}
+
+// writeManifest records checksums of everything in the backup directory.
+// Playlists whose saved track count differs from Spotify's are added to rep,
+// as are the changes since prev if the run is complete.
+func writeManifest(opts Options, rep *Report, prev *storage.Manifest, index []storage.IndexEntry, complete bool) {
+	log := opts.Logger
+	m, err := storage.BuildManifest(opts.OutDir, index)
+	if err != nil {
+		log.Warn("failed to build manifest", "err", err)
+		return
+	}
+	m.ToolVersion = opts.ToolVersion
+	m.StartedAt = rep.StartedAt
+	m.FinishedAt = time.Now().UTC()
+	m.Complete = complete
+	if complete && prev != nil {
+		rep.Changes = diff(prev, m)
+	}
+	for _, c := range m.PlaylistCounts {
+		if c.Mismatch() {
+			log.Warn("track count mismatch", "playlist", c.ID, "tracks", c.Tracks, "tracks_total", c.TracksTotal)
+			rep.CountMismatches = append(rep.CountMismatches, c)
+		}
+	}
+	manifestPath := filepath.Join(opts.OutDir, storage.ManifestFile)
+	if err := storage.WriteJSONFile(manifestPath, m); err != nil {
+		log.Warn("failed to write manifest", "file", storage.ManifestFile, "err", err)
+	} else {
+		rep.wrote(manifestPath)
+	}
+}
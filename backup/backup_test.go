@@ -0,0 +1,469 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"spotify-backup/spotify"
+	"spotify-backup/spotifytest"
+	"spotify-backup/storage"
+)
+
+func newFakeSpotify(t *testing.T) (*spotifytest.Server, *spotify.Client) {
+	t.Helper()
+	fx, err := spotifytest.LoadFixture("../testdata/account.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := spotifytest.NewServer(fx)
+	t.Cleanup(srv.Close)
+	return srv, srv.SpotifyClient()
+}
+
+func readIndex(t *testing.T, dir string) []storage.IndexEntry {
+	t.Helper()
+	index, err := storage.ReadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestBackupWritesPlaylistsAndIndex(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+
+	tok, err := client.RefreshAccessToken(context.Background(), srv.ClientID, srv.ClientSecret, srv.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Scope != srv.Scope {
+		t.Errorf("refreshed token scope = %q, want %q", tok.Scope, srv.Scope)
+	}
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: tok.AccessToken, OutDir: out, Followers: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	index := readIndex(t, out)
+	if len(index) != 3 {
+		t.Fatalf("index has %d entries, want 3", len(index))
+	}
+	wantFollowed := map[string]bool{"pl1mine": false, "pl2followed": true, "pl3collab": false}
+	for _, e := range index {
+		if e.Followed != wantFollowed[e.ID] {
+			t.Errorf("%s: followed = %v, want %v", e.ID, e.Followed, wantFollowed[e.ID])
+		}
+	}
+
+	sp, err := storage.ReadSavedPlaylist(filepath.Join(out, index[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.SchemaVersion != storage.SchemaVersion {
+		t.Errorf("schema_version = %d, want %d", sp.SchemaVersion, storage.SchemaVersion)
+	}
+	// five tracks at two per page exercises the paging "next" links
+	if len(sp.Tracks) != 5 || sp.TracksTotal != 5 {
+		t.Errorf("got %d tracks (total %d), want 5", len(sp.Tracks), sp.TracksTotal)
+	}
+	if isrc := sp.Tracks[0].Track.ExternalIDs["isrc"]; isrc != "USABC2400001" {
+		t.Errorf("isrc = %q", isrc)
+	}
+	if sp.Followers != 3 || sp.SnapshotID != "snap1" || sp.OwnerID != "alice" {
+		t.Errorf("playlist metadata not preserved: %+v", sp)
+	}
+	if len(sp.Images) != 2 || sp.Image != srv.URL+"/images/cover-640.jpg" {
+		t.Errorf("image = %q, images = %v; want largest of two", sp.Image, sp.Images)
+	}
+
+	img, err := os.ReadFile(filepath.Join(out, index[0].ImageFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(img) != "large cover" {
+		t.Errorf("downloaded image = %q, want the largest cover", img)
+	}
+}
+
+func TestBackupFilterAndExtraPlaylists(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+
+	opts := Options{
+		Client:      client,
+		AccessToken: srv.AccessToken,
+		OutDir:      out,
+		Filter:      &Filter{Scope: "owned"},
+		ExtraIDs:    []string{"pl4editorial", "pl1mine"},
+	}
+	if _, err := Backup(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, e := range readIndex(t, out) {
+		ids = append(ids, e.ID)
+		// listed playlists the user doesn't follow must not be followed on restore
+		if e.ID == "pl4editorial" && e.Followed {
+			t.Errorf("%s: followed = true for a playlist only listed in ExtraIDs", e.ID)
+		}
+	}
+	want := []string{"pl1mine", "pl3collab", "pl4editorial"}
+	if len(ids) != len(want) {
+		t.Fatalf("backed up %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("backed up %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestBackupRetriesRateLimitedRequests(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	srv.FailNext("/v1/playlists/pl1mine/tracks", http.StatusTooManyRequests, 3)
+
+	res, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(res.Report.Retries); got != 3 {
+		t.Errorf("report lists %d retries, want 3", got)
+	}
+	if !res.Report.OK() {
+		t.Errorf("outcome = %s, want %s", res.Report.Outcome, OutcomeSuccess)
+	}
+	index := readIndex(t, out)
+	if len(index) != 3 {
+		t.Fatalf("index has %d entries, want 3", len(index))
+	}
+	sp, err := storage.ReadSavedPlaylist(filepath.Join(out, index[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.Tracks) != 5 {
+		t.Errorf("got %d tracks after retries, want 5", len(sp.Tracks))
+	}
+}
+
+func TestBackupSkipsPlaylistOnUnauthorized(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	srv.FailNext("/v1/playlists/pl2followed/tracks", http.StatusUnauthorized, 1)
+
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range readIndex(t, out) {
+		if e.ID == "pl2followed" {
+			t.Errorf("playlist with failed tracks request should be left out of the index")
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(out, storage.ReportFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep Report
+	if err := json.Unmarshal(b, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Outcome != OutcomePartial || rep.Selected != 3 || rep.BackedUp != 2 {
+		t.Errorf("report = %+v, want a partial run with 2 of 3 playlists", &rep)
+	}
+	if len(rep.Failures) != 1 || rep.Failures[0].PlaylistID != "pl2followed" || rep.Failures[0].Stage != StageTracks {
+		t.Errorf("failures = %+v, want the tracks of pl2followed", rep.Failures)
+	}
+}
+
+func TestBackupSkipsFollowersByDefault(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r, "GET /v1/playlists/") && !strings.HasSuffix(r, "/tracks") {
+			t.Errorf("fetched %s without Followers", r)
+		}
+	}
+	sp, err := storage.ReadSavedPlaylist(filepath.Join(out, readIndex(t, out)[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Followers != 0 {
+		t.Errorf("followers = %d, want 0 when not fetched", sp.Followers)
+	}
+}
+
+func TestBackupWarnsAboutMissingFollowers(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	srv.FailNext("/v1/playlists/pl1mine?fields=followers", http.StatusInternalServerError, 1)
+
+	res, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out, Followers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the playlist itself is complete, so the run is too
+	rep := res.Report
+	if rep.Outcome != OutcomeSuccess || len(rep.Failures) != 0 || rep.BackedUp != 3 {
+		t.Errorf("report = %+v, want a successful run", rep)
+	}
+	if len(rep.Warnings) != 1 || rep.Warnings[0].PlaylistID != "pl1mine" || rep.Warnings[0].Stage != StageFollowers {
+		t.Errorf("warnings = %+v, want the followers of pl1mine", rep.Warnings)
+	}
+	if !strings.Contains(rep.Summary(), "1 warnings") {
+		t.Errorf("summary doesn't mention the warning:\n%s", rep.Summary())
+	}
+}
+
+func TestBackupReportsImageFailures(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	srv.FailNext("/images/", http.StatusNotFound, 1)
+
+	res, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := res.Report
+	if rep.Outcome != OutcomePartial || len(rep.Failures) != 1 || rep.Failures[0].Stage != StageImage {
+		t.Errorf("report = %+v, want one image failure", rep)
+	}
+	if !strings.Contains(rep.Summary(), "1 failures") {
+		t.Errorf("summary does not mention the failure:\n%s", rep.Summary())
+	}
+}
+
+func TestBackupInterruptedWritesPartialIndex(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.OnRequest = func(r *http.Request) {
+		if r.URL.Path == "/v1/playlists/pl2followed/tracks" {
+			cancel()
+		}
+	}
+
+	res, err := Backup(ctx, Options{Client: client, AccessToken: srv.AccessToken, OutDir: out})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if res == nil || !res.Incomplete {
+		t.Fatalf("result = %+v, want incomplete", res)
+	}
+	if _, err := os.Stat(filepath.Join(out, storage.IncompleteFile)); err != nil {
+		t.Errorf("incomplete marker missing: %v", err)
+	}
+	index := readIndex(t, out)
+	if len(index) == 0 || index[0].ID != "pl1mine" {
+		t.Fatalf("index = %+v, want the playlist finished before the interrupt", index)
+	}
+	for _, e := range index {
+		if e.ID == "pl3collab" {
+			t.Errorf("playlist after the interrupt was backed up")
+		}
+	}
+	tmps, _ := filepath.Glob(filepath.Join(out, "*", "*.tmp"))
+	if len(tmps) > 0 {
+		t.Errorf("temporary files left behind: %v", tmps)
+	}
+}
+
+func TestBackupResumesFromJournal(t *testing.T) {
+	defer func(n int) { checkpointMinTracks = n }(checkpointMinTracks)
+	checkpointMinTracks = 1
+
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pages := 0
+	srv.OnRequest = func(r *http.Request) {
+		// stop while fetching the second page of pl3collab's tracks
+		if r.URL.Path == "/v1/playlists/pl3collab/tracks" {
+			if pages++; pages == 2 {
+				cancel()
+			}
+		}
+	}
+	if _, err := Backup(ctx, Options{Client: client, AccessToken: srv.AccessToken, OutDir: out}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, storage.JournalDir, storage.JournalFile)); err != nil {
+		t.Fatalf("journal missing after interrupt: %v", err)
+	}
+
+	srv.OnRequest = nil
+	before := len(srv.Requests())
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, r := range srv.Requests()[before:] {
+		counts[r]++
+	}
+	if n := counts["GET /v1/playlists/pl1mine/tracks"] + counts["GET /v1/playlists/pl2followed/tracks"]; n != 0 {
+		t.Errorf("finished playlists fetched again (%d requests)", n)
+	}
+	if n := counts["GET /v1/playlists/pl3collab/tracks"]; n != 1 {
+		t.Errorf("pl3collab track pages fetched on resume = %d, want only the missing one", n)
+	}
+	if _, err := os.Stat(filepath.Join(out, storage.JournalDir)); !os.IsNotExist(err) {
+		t.Errorf("journal left behind after a complete run: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, storage.IncompleteFile)); !os.IsNotExist(err) {
+		t.Errorf("incomplete marker left behind: %v", err)
+	}
+
+	fresh := t.TempDir()
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: fresh}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readIndex(t, out), readIndex(t, fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed index = %+v, want %+v", got, want)
+	}
+	sp, err := storage.ReadSavedPlaylist(filepath.Join(out, readIndex(t, out)[2].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.ID != "pl3collab" || len(sp.Tracks) != 3 {
+		t.Errorf("resumed playlist %s has %d tracks, want pl3collab with 3", sp.ID, len(sp.Tracks))
+	}
+}
+
+func TestBackupManifestVerifies(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out, ToolVersion: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := storage.ReadManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Complete || m.ToolVersion != "test" || m.Playlists != 3 || m.TracksExpected != 9 || m.TracksSaved != 9 {
+		t.Errorf("manifest = %+v", m)
+	}
+	files := map[string]bool{}
+	for _, f := range m.Files {
+		files[f.Path] = true
+	}
+	for _, want := range []string{storage.IndexFile, "images/playlist-pl1mine.jpg"} {
+		if !files[want] {
+			t.Errorf("manifest does not list %s", want)
+		}
+	}
+	if problems, err := storage.Verify(out, m); err != nil || len(problems) != 0 {
+		t.Fatalf("fresh backup: problems = %v, err = %v", problems, err)
+	}
+
+	index := readIndex(t, out)
+	os.Remove(filepath.Join(out, index[0].File))
+	os.Truncate(filepath.Join(out, index[1].File), 10)
+	b, _ := os.ReadFile(filepath.Join(out, storage.IndexFile))
+	b[len(b)-2] = ' '
+	os.WriteFile(filepath.Join(out, storage.IndexFile), b, 0o644)
+
+	problems, err := storage.Verify(out, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range problems {
+		got[p.Path] = p.Kind
+	}
+	want := map[string]string{
+		index[0].File:     storage.ProblemMissing,
+		index[1].File:     storage.ProblemTruncated,
+		storage.IndexFile: storage.ProblemModified,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems = %v, want %v", got, want)
+	}
+}
+
+func TestBackupReportsChangesSincePreviousRun(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	filter, err := NewFilter("all", "", "", "", "pl3collab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out, Filter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Report.Changes != nil {
+		t.Errorf("first run reports changes: %+v", res.Report.Changes)
+	}
+
+	res, err = Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := res.Report.Changes
+	if c == nil || !reflect.DeepEqual(c.Added, []string{"Party"}) || len(c.Removed) != 0 || len(c.Tracks) != 0 {
+		t.Errorf("changes = %+v, want only Party added", c)
+	}
+}
+
+func TestBackupFailsWithInvalidToken(t *testing.T) {
+	_, client := newFakeSpotify(t)
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: "expired", OutDir: t.TempDir()}); err == nil {
+		t.Fatal("expected an error for an invalid access token")
+	}
+}
+
+func TestClientCredentialsPublicBackup(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+
+	tok, err := client.ClientCredentialsToken(context.Background(), srv.ClientID, srv.ClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Client: client, AccessToken: tok, OutDir: out, PublicOnly: true, ExtraIDs: []string{"pl4editorial"}}
+	if _, err := Backup(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	index := readIndex(t, out)
+	if len(index) != 1 || index[0].ID != "pl4editorial" {
+		t.Fatalf("index = %+v, want only the listed playlist", index)
+	}
+	if index[0].Followed {
+		t.Errorf("index = %+v, want no followed playlists without a user", index)
+	}
+	for _, r := range srv.Requests() {
+		if r == "GET /v1/me" || r == "GET /v1/me/playlists" {
+			t.Errorf("public-only backup must not call %s", r)
+		}
+	}
+}
+
+func TestSettingsOverride(t *testing.T) {
+	saved := Settings{OutDir: "/data/out", AllImages: true, IncludeName: "^Foo", ExtraIDs: []string{"pl4editorial"}}
+	empty, off := "", false
+
+	// nothing set keeps everything
+	if got := saved.Override(Overrides{}); !reflect.DeepEqual(got, saved) {
+		t.Errorf("empty override = %+v, want %+v", got, saved)
+	}
+	// values set to empty or false still override
+	got := saved.Override(Overrides{AllImages: &off, IncludeName: &empty, ExtraIDs: &[]string{}})
+	want := Settings{OutDir: "/data/out", ExtraIDs: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("override = %+v, want %+v", got, want)
+	}
+}
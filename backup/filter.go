@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"spotify-backup/spotify"
+)
+
+// Filter decides which of the user's playlists are backed up.
+type Filter struct {
+	Scope       string // all, owned, followed or collaborative
+	IncludeName *regexp.Regexp
+	ExcludeName *regexp.Regexp
+	IncludeIDs  map[string]bool
+	ExcludeIDs  map[string]bool
+}
+
+// NewFilter builds a Filter from its textual settings. Empty values mean
+// no restriction; the ID lists are comma or whitespace separated.
+func NewFilter(scope, includeName, excludeName, includeIDs, excludeIDs string) (*Filter, error) {
+	f := &Filter{
+		Scope:      strings.ToLower(strings.TrimSpace(scope)),
+		IncludeIDs: SplitIDList(includeIDs),
+		ExcludeIDs: SplitIDList(excludeIDs),
+	}
+	switch f.Scope {
+	case "":
+		f.Scope = "all"
+	case "all", "owned", "followed", "collaborative":
+	default:
+		return nil, fmt.Errorf("unknown scope %q (want all, owned, followed or collaborative)", f.Scope)
+	}
+	var err error
+	if includeName != "" {
+		if f.IncludeName, err = regexp.Compile(includeName); err != nil {
+			return nil, fmt.Errorf("include name: %w", err)
+		}
+	}
+	if excludeName != "" {
+		if f.ExcludeName, err = regexp.Compile(excludeName); err != nil {
+			return nil, fmt.Errorf("exclude name: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// Match reports whether p should be backed up for the user with the given ID.
+func (f *Filter) Match(p spotify.Playlist, userID string) bool {
+	owned := p.Owner.ID == userID
+	switch f.Scope {
+	case "owned":
+		if !owned {
+			return false
+		}
+	case "followed":
+		if owned {
+			return false
+		}
+	case "collaborative":
+		if !p.Collaborative {
+			return false
+		}
+	}
+	if len(f.IncludeIDs) > 0 && !f.IncludeIDs[p.ID] {
+		return false
+	}
+	if f.ExcludeIDs[p.ID] {
+		return false
+	}
+	if f.IncludeName != nil && !f.IncludeName.MatchString(p.Name) {
+		return false
+	}
+	if f.ExcludeName != nil && f.ExcludeName.MatchString(p.Name) {
+		return false
+	}
+	return true
+}
+
+// SplitIDList parses a comma or whitespace separated list of playlist IDs.
+func SplitIDList(s string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, id := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' }) {
+		ids[id] = true
+	}
+	return ids
+}
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"spotify-backup/spotify"
+)
+
+func TestFilter(t *testing.T) {
+	playlist := func(id, name, owner string, collaborative bool) spotify.Playlist {
+		p := spotify.Playlist{ID: id, Name: name, Collaborative: collaborative}
+		p.Owner.ID = owner
+		return p
+	}
+	playlists := []spotify.Playlist{
+		playlist("mine", "Road Trip", "alice", false),
+		playlist("followed", "Jazz Classics", "bob", false),
+		playlist("collab", "Party Mix", "bob", true),
+		playlist("mycollab", "Roadhouse Blues", "alice", true),
+	}
+
+	tests := []struct {
+		name                                                    string
+		scope, includeName, excludeName, includeIDs, excludeIDs string
+		want                                                    []string
+	}{
+		{name: "default", want: []string{"mine", "followed", "collab", "mycollab"}},
+		{name: "owned", scope: "Owned", want: []string{"mine", "mycollab"}},
+		{name: "followed", scope: "followed", want: []string{"followed", "collab"}},
+		{name: "collaborative", scope: "collaborative", want: []string{"collab", "mycollab"}},
+		{name: "include name", includeName: "^Road", want: []string{"mine", "mycollab"}},
+		{name: "exclude name", excludeName: "(?i)jazz|blues", want: []string{"mine", "collab"}},
+		{name: "include IDs", includeIDs: "followed, collab\nmissing", want: []string{"followed", "collab"}},
+		{name: "exclude IDs", excludeIDs: "mine mycollab", want: []string{"followed", "collab"}},
+		{name: "combined", scope: "owned", includeName: "Road", excludeIDs: "mine", want: []string{"mycollab"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := NewFilter(tc.scope, tc.includeName, tc.excludeName, tc.includeIDs, tc.excludeIDs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range playlists {
+				if f.Match(p, "alice") {
+					got = append(got, p.ID)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("matched %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	tests := []struct {
+		name                            string
+		scope, includeName, excludeName string
+		err                             string
+	}{
+		{name: "scope", scope: "mine", err: "unknown scope"},
+		{name: "include name", includeName: "(", err: "include name"},
+		{name: "exclude name", excludeName: "[a-", err: "exclude name"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFilter(tc.scope, tc.includeName, tc.excludeName, "", "")
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
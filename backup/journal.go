@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"spotify-backup/spotify"
+	"spotify-backup/storage"
+)
+
+// checkpointMinTracks is the playlist size from which track pages are
+// checkpointed individually, so a resumed run continues mid-playlist.
+var checkpointMinTracks = 500
+
+// journalRecord is one line of the journal file.
+type journalRecord struct {
+	Type       string              `json:"type"` // "done" or "page"
+	ID         string              `json:"id"`
+	SnapshotID string              `json:"snapshot_id,omitempty"`
+	Entry      *storage.IndexEntry `json:"entry,omitempty"` // done: the playlist's index entry
+	Next       string              `json:"next,omitempty"`  // page: URL of the following page
+	Count      int                 `json:"count,omitempty"` // page: track items saved so far
+}
+
+// journal records the progress of a run in storage.JournalDir so that an
+// interrupted run can be resumed. Finished playlists are logged with their
+// index entry; large playlists also log each page of tracks, whose items are
+// kept in a per-playlist file next to the journal.
+type journal struct {
+	dir   string
+	f     *os.File
+	done  map[string]journalRecord
+	pages map[string]journalRecord // last page record per playlist
+}
+
+// openJournal starts a journal in outDir. With resume the existing journal is
+// loaded, otherwise any leftover from an earlier run is discarded.
+func openJournal(outDir string, resume bool) (*journal, error) {
+	j := &journal{
+		dir:   filepath.Join(outDir, storage.JournalDir),
+		done:  make(map[string]journalRecord),
+		pages: make(map[string]journalRecord),
+	}
+	if resume {
+		if err := j.load(); err != nil {
+			return nil, err
+		}
+	} else if err := os.RemoveAll(j.dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(j.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(j.dir, storage.JournalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+func (j *journal) load() error {
+	f, err := os.Open(filepath.Join(j.dir, storage.JournalFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		var rec journalRecord
+		// a crash can leave a torn last line; everything before it counts
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			break
+		}
+		switch rec.Type {
+		case "done":
+			j.done[rec.ID] = rec
+		case "page":
+			j.pages[rec.ID] = rec
+		}
+	}
+	return sc.Err()
+}
+
+func (j *journal) append(rec journalRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// completed returns the index entry of a playlist finished by an earlier
+// attempt, provided it hasn't changed since and its file is still there.
+func (j *journal) completed(outDir string, p spotify.Playlist) (storage.IndexEntry, bool) {
+	rec, ok := j.done[p.ID]
+	if !ok || rec.Entry == nil || rec.SnapshotID != p.SnapshotID {
+		return storage.IndexEntry{}, false
+	}
+	if _, err := os.Stat(filepath.Join(outDir, rec.Entry.File)); err != nil {
+		return storage.IndexEntry{}, false
+	}
+	return *rec.Entry, true
+}
+
+// markDone records that a playlist and its images were written.
+func (j *journal) markDone(p spotify.Playlist, entry storage.IndexEntry) error {
+	if err := j.append(journalRecord{Type: "done", ID: p.ID, SnapshotID: p.SnapshotID, Entry: &entry}); err != nil {
+		return err
+	}
+	os.Remove(j.tracksPath(p.ID))
+	return nil
+}
+
+func (j *journal) tracksPath(playlistID string) string {
+	return filepath.Join(j.dir, storage.SafeFilename(playlistID)+".tracks.jsonl")
+}
+
+// cursor returns the track items saved for a partially fetched playlist and
+// the URL to continue from. ok is false when there is nothing to resume.
+func (j *journal) cursor(p spotify.Playlist) (tracks []spotify.TrackItem, next string, ok bool) {
+	rec, found := j.pages[p.ID]
+	if !found || rec.SnapshotID != p.SnapshotID {
+		return nil, "", false
+	}
+	f, err := os.Open(j.tracksPath(p.ID))
+	if err != nil {
+		return nil, "", false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for len(tracks) < rec.Count && sc.Scan() {
+		var it spotify.TrackItem
+		if err := json.Unmarshal(sc.Bytes(), &it); err != nil {
+			return nil, "", false
+		}
+		tracks = append(tracks, it)
+	}
+	if len(tracks) != rec.Count {
+		return nil, "", false
+	}
+	return tracks, rec.Next, true
+}
+
+// resetTracks discards saved track items before a playlist is fetched anew.
+func (j *journal) resetTracks(playlistID string) {
+	delete(j.pages, playlistID)
+	os.Remove(j.tracksPath(playlistID))
+}
+
+// savePage appends a page of track items and then records the cursor, so a
+// resumed run never sees a cursor without its items.
+func (j *journal) savePage(p spotify.Playlist, items []spotify.TrackItem, count int, next string) error {
+	f, err := os.OpenFile(j.tracksPath(p.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, it := range items {
+		if err := enc.Encode(it); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	rec := journalRecord{Type: "page", ID: p.ID, SnapshotID: p.SnapshotID, Next: next, Count: count}
+	j.pages[p.ID] = rec
+	return j.append(rec)
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// remove deletes the journal after a run that completed.
+func (j *journal) remove() error {
+	j.f.Close()
+	return os.RemoveAll(j.dir)
+}
+
+// fetchTracks fetches a playlist's track items. Large playlists are
+// checkpointed page by page and continue from the journal if possible.
+func fetchTracks(ctx context.Context, log *slog.Logger, client *spotify.Client, accessToken string, j *journal, p spotify.Playlist) ([]spotify.TrackItem, error) {
+	if p.Tracks.Total < checkpointMinTracks {
+		return client.FetchAllPlaylistTracks(ctx, accessToken, p.ID)
+	}
+
+	tracks, next, ok := j.cursor(p)
+	if ok {
+		log.Info("resuming playlist", "playlist", p.ID, "track", len(tracks), "tracks_total", p.Tracks.Total)
+	} else {
+		j.resetTracks(p.ID)
+		tracks, next = nil, client.PlaylistTracksURL(p.ID)
+	}
+	for next != "" {
+		items, n, err := client.FetchPlaylistTracksPage(ctx, accessToken, next)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, items...)
+		next = n
+		if err := j.savePage(p, items, len(tracks), next); err != nil {
+			return nil, fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+	return tracks, nil
+}
@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"spotify-backup/metrics"
+	"spotify-backup/storage"
+)
+
+// Outcomes of a run as recorded in the report.
+const (
+	OutcomeSuccess     = "success"
+	OutcomePartial     = "partial"     // finished, but something was skipped or is incomplete
+	OutcomeInterrupted = "interrupted" // cancelled before all playlists were handled
+	OutcomeFailed      = "failed"      // nothing was backed up
+)
+
+// Stages in which a failure can occur.
+const (
+	StagePlaylist  = "playlist" // fetching a listed playlist
+	StageTracks    = "tracks"
+	StageFollowers = "followers" // only a warning, the playlist is complete without
+	StageWrite     = "write"
+	StageExport    = "export"
+	StageImage     = "image"
+)
+
+// Report is written to storage.ReportFile after every run.
+type Report struct {
+	ToolVersion string    `json:"tool_version"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	Selected    int       `json:"playlists_selected"`
+	BackedUp    int       `json:"playlists_backed_up"`
+	Failures    []Failure `json:"failures"`
+	// Warnings are problems that don't make the backup incomplete, such as
+	// a follower count that couldn't be fetched.
+	Warnings        []Failure               `json:"warnings,omitempty"`
+	CountMismatches []storage.PlaylistCount `json:"count_mismatches"`
+	Retries         []Retry                 `json:"retries"`
+	BytesWritten    int64                   `json:"bytes_written"` // not counting the report itself
+	// Changes since the previous run; nil if there was none or this run
+	// didn't complete.
+	Changes *Changes `json:"changes,omitempty"`
+
+	mu  sync.Mutex // guards Retries, which the client appends to
+	log *slog.Logger
+}
+
+// Failure is a playlist, or part of one, that could not be backed up.
+type Failure struct {
+	PlaylistID string `json:"playlist_id"`
+	Name       string `json:"name,omitempty"`
+	Stage      string `json:"stage"`
+	Error      string `json:"error"`
+}
+
+// Retry is a request that was repeated after a 429 response.
+type Retry struct {
+	URL         string  `json:"url"`
+	WaitSeconds float64 `json:"wait_seconds"`
+}
+
+// Changes compares a complete run with the one before it.
+type Changes struct {
+	Added   []string      `json:"added"`   // names of new playlists
+	Removed []string      `json:"removed"` // names of playlists no longer backed up
+	Tracks  []TrackChange `json:"tracks"`  // playlists whose track count changed
+}
+
+// TrackChange is a playlist that gained or lost tracks.
+type TrackChange struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+}
+
+// Empty reports whether nothing changed.
+func (c *Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Tracks) == 0
+}
+
+// diff compares the playlists of two manifests.
+func diff(prev, cur *storage.Manifest) *Changes {
+	c := &Changes{}
+	before := make(map[string]storage.PlaylistCount, len(prev.PlaylistCounts))
+	for _, p := range prev.PlaylistCounts {
+		before[p.ID] = p
+	}
+	for _, p := range cur.PlaylistCounts {
+		old, ok := before[p.ID]
+		delete(before, p.ID)
+		switch {
+		case !ok:
+			c.Added = append(c.Added, p.Name)
+		case old.Tracks != p.Tracks:
+			c.Tracks = append(c.Tracks, TrackChange{ID: p.ID, Name: p.Name, Before: old.Tracks, After: p.Tracks})
+		}
+	}
+	for _, p := range prev.PlaylistCounts {
+		if _, gone := before[p.ID]; gone {
+			c.Removed = append(c.Removed, p.Name)
+		}
+	}
+	return c
+}
+
+// fail records a failure and logs it as a warning.
+func (r *Report) fail(playlistID, name, stage string, err error) {
+	r.log.Warn("playlist "+stage+" failed", "playlist", playlistID, "name", name, "stage", stage, "err", err)
+	r.Failures = append(r.Failures, Failure{PlaylistID: playlistID, Name: name, Stage: stage, Error: err.Error()})
+}
+
+// warn records a problem that leaves the playlist backed up.
+func (r *Report) warn(playlistID, name, stage string, err error) {
+	r.log.Warn("playlist "+stage+" failed", "playlist", playlistID, "name", name, "stage", stage, "err", err)
+	r.Warnings = append(r.Warnings, Failure{PlaylistID: playlistID, Name: name, Stage: stage, Error: err.Error()})
+}
+
+func (r *Report) retry(urlStr string, wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Retries = append(r.Retries, Retry{URL: urlStr, WaitSeconds: wait.Seconds()})
+}
+
+// wrote adds the size of a file just written to the run's totals.
+func (r *Report) wrote(path string) {
+	if fi, err := os.Stat(path); err == nil {
+		r.BytesWritten += fi.Size()
+		metrics.BytesWritten.Add(float64(fi.Size()))
+	}
+}
+
+// finish sets the outcome from the run's result and error.
+func (r *Report) finish(res *Result, err error) {
+	r.FinishedAt = time.Now().UTC()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	switch {
+	case res == nil:
+		r.Outcome = OutcomeFailed
+	case res.Incomplete:
+		r.Outcome = OutcomeInterrupted
+	case len(r.Failures) > 0 || len(r.CountMismatches) > 0:
+		r.Outcome = OutcomePartial
+	default:
+		r.Outcome = OutcomeSuccess
+	}
+}
+
+// OK reports whether the run backed up everything it selected.
+func (r *Report) OK() bool {
+	return r.Outcome == OutcomeSuccess
+}
+
+// Summary renders the report for humans.
+func (r *Report) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run %s: %d of %d playlists backed up in %s\n",
+		r.Outcome, r.BackedUp, r.Selected, r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+	if r.Error != "" {
+		fmt.Fprintf(&b, "  error: %s\n", r.Error)
+	}
+	if len(r.Failures) > 0 {
+		fmt.Fprintf(&b, "  %d failures:\n", len(r.Failures))
+		for _, f := range r.Failures {
+			fmt.Fprintf(&b, "    - %s %q (%s): %s\n", f.Stage, f.Name, f.PlaylistID, f.Error)
+		}
+	}
+	if len(r.Warnings) > 0 {
+		fmt.Fprintf(&b, "  %d warnings:\n", len(r.Warnings))
+		for _, w := range r.Warnings {
+			fmt.Fprintf(&b, "    - %s %q (%s): %s\n", w.Stage, w.Name, w.PlaylistID, w.Error)
+		}
+	}
+	if len(r.CountMismatches) > 0 {
+		fmt.Fprintf(&b, "  %d playlists with missing or extra tracks:\n", len(r.CountMismatches))
+		for _, c := range r.CountMismatches {
+			fmt.Fprintf(&b, "    - %s: %d of %d tracks\n", c.ID, c.Tracks, c.TracksTotal)
+		}
+	}
+	if len(r.Retries) > 0 {
+		fmt.Fprintf(&b, "  %d requests retried after rate limiting\n", len(r.Retries))
+	}
+	if c := r.Changes; c != nil && !c.Empty() {
+		fmt.Fprintf(&b, "  changes since the previous backup:\n")
+		for _, name := range c.Added {
+			fmt.Fprintf(&b, "    + %s\n", name)
+		}
+		for _, name := range c.Removed {
+			fmt.Fprintf(&b, "    - %s\n", name)
+		}
+		for _, t := range c.Tracks {
+			fmt.Fprintf(&b, "    ~ %s: %d -> %d tracks\n", t.Name, t.Before, t.After)
+		}
+	}
+	return b.String()
+}
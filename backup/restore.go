@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"spotify-backup/spotify"
+	"spotify-backup/storage"
+)
+
+// What Restore did, or would do, with a playlist of the backup.
+const (
+	RestoreFollowed  = "followed"   // followed again
+	RestoreCreated   = "created"    // recreated from the saved tracks
+	RestoreInLibrary = "in_library" // still there, left alone
+	RestoreNotOwned  = "not_owned"  // listed by ID but never in the library, left alone
+)
+
+// Stages in which a restore failure can occur, besides StageTracks.
+const (
+	StageFollow = "follow"
+	StageCreate = "create"
+)
+
+// RestoreOptions configures a restore. Client, AccessToken and Dir are
+// required; the token needs auth.RestoreScopes unless DryRun is set.
+type RestoreOptions struct {
+	Client      *spotify.Client
+	AccessToken string
+	Dir         string   // backup directory
+	IDs         []string // playlists of the backup to restore; empty means all
+	DryRun      bool     // only report what would be done
+	// Logger receives progress; nil means slog.Default().
+	Logger *slog.Logger
+}
+
+// RestoredPlaylist is a playlist of the backup and what became of it.
+type RestoredPlaylist struct {
+	ID     string // ID in the backup
+	Name   string
+	Action string
+	NewID  string // ID of the recreated playlist
+	Tracks int    // tracks added to the recreated playlist
+	// Local files are kept in the backup but can't be added through the API.
+	LocalTracks int
+}
+
+// RestoreResult summarizes a restore.
+type RestoreResult struct {
+	DryRun    bool
+	Playlists []RestoredPlaylist
+	Failures  []Failure
+}
+
+// Restore puts the playlists of a backup back into the user's library:
+// followed playlists are followed again and the user's own playlists are
+// recreated with their name, description, visibility and tracks. Playlists
+// still in the library are left alone, as are owned playlists whose name is
+// taken by one of the user's playlists, e.g. one recreated by an earlier
+// restore. Failures for single playlists are reported and skipped.
+func Restore(ctx context.Context, opts RestoreOptions) (*RestoreResult, error) {
+	log := opts.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	index, err := storage.ReadIndex(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	if len(opts.IDs) > 0 {
+		byID := make(map[string]storage.IndexEntry, len(index))
+		for _, e := range index {
+			byID[e.ID] = e
+		}
+		var selected []storage.IndexEntry
+		for _, id := range opts.IDs {
+			e, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("playlist %s is not in the backup", id)
+			}
+			selected = append(selected, e)
+		}
+		index = selected
+	}
+
+	userID, err := opts.Client.FetchCurrentUserID(ctx, opts.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("fetch user: %w", err)
+	}
+	library, err := opts.Client.FetchAllPlaylists(ctx, opts.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("fetch playlists: %w", err)
+	}
+	inLibrary := make(map[string]bool, len(library))
+	ownedNames := make(map[string]bool)
+	for _, p := range library {
+		inLibrary[p.ID] = true
+		if p.Owner.ID == userID {
+			ownedNames[p.Name] = true
+		}
+	}
+
+	res := &RestoreResult{DryRun: opts.DryRun}
+	for _, e := range index {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		sp, err := storage.ReadSavedPlaylist(filepath.Join(opts.Dir, e.File))
+		if err != nil {
+			return res, fmt.Errorf("read %s: %w", e.File, err)
+		}
+		rp := RestoredPlaylist{ID: e.ID, Name: sp.Name}
+		// backups from before owner_id was saved only tell followed
+		// playlists apart
+		owned := !e.Followed && (sp.OwnerID == "" || sp.OwnerID == userID)
+		switch {
+		case inLibrary[e.ID] || owned && ownedNames[sp.Name]:
+			rp.Action = RestoreInLibrary
+		case e.Followed:
+			rp.Action = RestoreFollowed
+			if !opts.DryRun {
+				if err := opts.Client.FollowPlaylist(ctx, opts.AccessToken, e.ID, true); err != nil {
+					res.fail(e.ID, sp.Name, StageFollow, err)
+					continue
+				}
+				log.Info("followed playlist", "id", e.ID, "name", sp.Name)
+			}
+		case owned:
+			rp.Action = RestoreCreated
+			var uris []string
+			for _, t := range sp.Tracks {
+				if t.IsLocal || t.Track.IsLocal || t.Track.URI == "" || strings.HasPrefix(t.Track.URI, "spotify:local:") {
+					rp.LocalTracks++
+					continue
+				}
+				uris = append(uris, t.Track.URI)
+			}
+			rp.Tracks = len(uris)
+			if !opts.DryRun {
+				created, err := opts.Client.CreatePlaylist(ctx, opts.AccessToken, userID, spotify.NewPlaylist{
+					Name:          sp.Name,
+					Description:   sp.Description,
+					Public:        sp.Public != nil && *sp.Public && !sp.Collaborative,
+					Collaborative: sp.Collaborative,
+				})
+				if err != nil {
+					res.fail(e.ID, sp.Name, StageCreate, err)
+					continue
+				}
+				rp.NewID = created.ID
+				ownedNames[sp.Name] = true
+				if err := opts.Client.AddPlaylistTracks(ctx, opts.AccessToken, created.ID, uris); err != nil {
+					res.fail(e.ID, sp.Name, StageTracks, fmt.Errorf("recreated as %s, but adding tracks failed: %w", created.ID, err))
+					rp.Tracks = 0
+				}
+				log.Info("recreated playlist", "id", e.ID, "name", sp.Name, "new_id", rp.NewID, "tracks", rp.Tracks)
+			}
+		default:
+			rp.Action = RestoreNotOwned
+		}
+		res.Playlists = append(res.Playlists, rp)
+	}
+	return res, nil
+}
+
+func (r *RestoreResult) fail(id, name, stage string, err error) {
+	r.Failures = append(r.Failures, Failure{PlaylistID: id, Name: name, Stage: stage, Error: err.Error()})
+}
+
+// Summary is a human-readable overview of the restore.
+func (r *RestoreResult) Summary() string {
+	var b strings.Builder
+	counts := make(map[string]int)
+	for _, p := range r.Playlists {
+		counts[p.Action]++
+	}
+	verb := "Restored"
+	if r.DryRun {
+		verb = "Would restore"
+	}
+	fmt.Fprintf(&b, "%s %d playlists: %d followed, %d recreated; %d still in the library, %d not yours to restore\n",
+		verb, counts[RestoreFollowed]+counts[RestoreCreated], counts[RestoreFollowed], counts[RestoreCreated],
+		counts[RestoreInLibrary], counts[RestoreNotOwned])
+	for _, p := range r.Playlists {
+		switch p.Action {
+		case RestoreFollowed:
+			fmt.Fprintf(&b, "  + %s (%s): followed\n", p.Name, p.ID)
+		case RestoreCreated:
+			fmt.Fprintf(&b, "  + %s (%s): recreated", p.Name, p.ID)
+			if p.NewID != "" {
+				fmt.Fprintf(&b, " as %s", p.NewID)
+			}
+			fmt.Fprintf(&b, " with %d tracks", p.Tracks)
+			if p.LocalTracks > 0 {
+				fmt.Fprintf(&b, ", %d local files left out", p.LocalTracks)
+			}
+			fmt.Fprintln(&b)
+		}
+	}
+	if len(r.Failures) > 0 {
+		fmt.Fprintf(&b, "  %d failures:\n", len(r.Failures))
+		for _, f := range r.Failures {
+			fmt.Fprintf(&b, "    - %s %q (%s): %s\n", f.Stage, f.Name, f.PlaylistID, f.Error)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"spotify-backup/spotifytest"
+)
+
+func TestRestore(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	ctx := context.Background()
+
+	opts := Options{Client: client, AccessToken: srv.AccessToken, OutDir: out, ExtraIDs: []string{"pl4editorial"}}
+	if _, err := Backup(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	var wantURIs []string
+	srv.Update(func(f *spotifytest.Fixture) {
+		// delete the own playlist and unfollow the followed one
+		var kept []spotifytest.Playlist
+		for _, p := range f.Playlists {
+			switch p.ID {
+			case "pl1mine":
+				for _, raw := range p.Tracks {
+					var item struct {
+						Track struct {
+							URI string `json:"uri"`
+						} `json:"track"`
+					}
+					json.Unmarshal(raw, &item)
+					wantURIs = append(wantURIs, item.Track.URI)
+				}
+			case "pl2followed":
+				f.Public = append(f.Public, p)
+			default:
+				kept = append(kept, p)
+			}
+		}
+		f.Playlists = kept
+	})
+
+	ropts := RestoreOptions{Client: client, AccessToken: srv.AccessToken, Dir: out, DryRun: true}
+	res, err := Restore(ctx, ropts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := func(res *RestoreResult) map[string]string {
+		m := make(map[string]string)
+		for _, p := range res.Playlists {
+			m[p.ID] = p.Action
+		}
+		return m
+	}
+	want := map[string]string{
+		"pl1mine":      RestoreCreated,
+		"pl2followed":  RestoreFollowed,
+		"pl3collab":    RestoreInLibrary,
+		"pl4editorial": RestoreNotOwned,
+	}
+	if got := actions(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run actions = %v, want %v", got, want)
+	}
+	for _, r := range srv.Requests() {
+		if !strings.HasPrefix(r, "GET ") {
+			t.Errorf("dry run sent %s", r)
+		}
+	}
+
+	ropts.DryRun = false
+	res, err = Restore(ctx, ropts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failures) > 0 {
+		t.Fatalf("failures: %+v", res.Failures)
+	}
+	if got := actions(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+	var newID string
+	for _, p := range res.Playlists {
+		if p.ID == "pl1mine" {
+			newID = p.NewID
+		}
+	}
+	srv.Update(func(f *spotifytest.Fixture) {
+		var ids []string
+		for _, p := range f.Playlists {
+			ids = append(ids, p.ID)
+			if p.ID != newID {
+				continue
+			}
+			if p.Name != "Road Trip" || p.Public == nil || !*p.Public || p.Collaborative {
+				t.Errorf("recreated playlist = %q public %v collaborative %v", p.Name, p.Public, p.Collaborative)
+			}
+			var uris []string
+			for _, raw := range p.Tracks {
+				var item struct {
+					Track struct {
+						URI string `json:"uri"`
+					} `json:"track"`
+				}
+				json.Unmarshal(raw, &item)
+				uris = append(uris, item.Track.URI)
+			}
+			if !slices.Equal(uris, wantURIs) {
+				t.Errorf("recreated tracks = %v, want %v", uris, wantURIs)
+			}
+		}
+		if !slices.Contains(ids, "pl2followed") || newID == "" || !slices.Contains(ids, newID) {
+			t.Errorf("library = %v, want pl2followed and the recreated %q", ids, newID)
+		}
+	})
+
+	// a second run finds everything in place
+	res, err = Restore(ctx, ropts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range res.Playlists {
+		if p.Action == RestoreCreated || p.Action == RestoreFollowed {
+			t.Errorf("second run: %s %s again", p.ID, p.Action)
+		}
+	}
+}
+
+func TestRestoreUnknownPlaylist(t *testing.T) {
+	srv, client := newFakeSpotify(t)
+	out := t.TempDir()
+	if _, err := Backup(context.Background(), Options{Client: client, AccessToken: srv.AccessToken, OutDir: out}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Restore(context.Background(), RestoreOptions{Client: client, AccessToken: srv.AccessToken, Dir: out, IDs: []string{"nope"}})
+	if err == nil || !strings.Contains(err.Error(), "not in the backup") {
+		t.Errorf("err = %v, want playlist not in the backup", err)
+	}
+}
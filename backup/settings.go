@@ -0,0 +1,73 @@
+package backup
+
+import "fmt"
+
+// Settings are the backup options in their textual form, as set through
+// the environment, so they can be saved and loaded again.
+type Settings struct {
+	OutDir      string   `json:"out_dir,omitempty"`
+	AllImages   bool     `json:"all_images,omitempty"`
+	Followers   bool     `json:"followers,omitempty"`
+	Scope       string   `json:"playlist_scope,omitempty"`
+	IncludeName string   `json:"playlist_include_name,omitempty"`
+	ExcludeName string   `json:"playlist_exclude_name,omitempty"`
+	IncludeIDs  string   `json:"playlist_include_ids,omitempty"`
+	ExcludeIDs  string   `json:"playlist_exclude_ids,omitempty"`
+	ExtraIDs    []string `json:"extra_playlist_ids,omitempty"`
+}
+
+// Overrides replace some of the Settings, e.g. those set in the
+// environment. Nil fields keep the current value, so a value set on purpose
+// overrides even when it is empty or false.
+type Overrides struct {
+	OutDir      *string
+	AllImages   *bool
+	Followers   *bool
+	Scope       *string
+	IncludeName *string
+	ExcludeName *string
+	IncludeIDs  *string
+	ExcludeIDs  *string
+	ExtraIDs    *[]string
+}
+
+// Override returns s with the fields set in o replacing its own.
+func (s Settings) Override(o Overrides) Settings {
+	set := func(dst *string, v *string) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&s.OutDir, o.OutDir)
+	set(&s.Scope, o.Scope)
+	set(&s.IncludeName, o.IncludeName)
+	set(&s.ExcludeName, o.ExcludeName)
+	set(&s.IncludeIDs, o.IncludeIDs)
+	set(&s.ExcludeIDs, o.ExcludeIDs)
+	if o.AllImages != nil {
+		s.AllImages = *o.AllImages
+	}
+	if o.Followers != nil {
+		s.Followers = *o.Followers
+	}
+	if o.ExtraIDs != nil {
+		s.ExtraIDs = *o.ExtraIDs
+	}
+	return s
+}
+
+// Options builds the options described by s. Client, AccessToken and
+// ToolVersion are left to the caller.
+func (s Settings) Options() (Options, error) {
+	filter, err := NewFilter(s.Scope, s.IncludeName, s.ExcludeName, s.IncludeIDs, s.ExcludeIDs)
+	if err != nil {
+		return Options{}, fmt.Errorf("playlist filter: %w", err)
+	}
+	return Options{
+		OutDir:    s.OutDir,
+		AllImages: s.AllImages,
+		Followers: s.Followers,
+		Filter:    filter,
+		ExtraIDs:  s.ExtraIDs,
+	}, nil
+}
@@ -0,0 +1,52 @@
+// Package export writes backed up playlists in the supported file formats.
+package export
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"spotify-backup/storage"
+)
+
+// Exporter writes one playlist below a backup directory and returns the
+// path of the written file relative to that directory.
+type Exporter interface {
+	Name() string
+	Export(dir string, p *storage.SavedPlaylist) (string, error)
+}
+
+// HistoryExporter is implemented by the exporters that can also write the
+// listening history imported from Spotify's account data export.
+type HistoryExporter interface {
+	Name() string
+	ExportHistory(dir string, h *storage.History) (string, error)
+}
+
+// JSON writes the canonical playlist file referenced by the index.
+type JSON struct{}
+
+func (JSON) Name() string { return "json" }
+
+func (JSON) Export(dir string, p *storage.SavedPlaylist) (string, error) {
+	rel := filepath.Join(storage.PlaylistsDir, storage.SafeFilename(fmt.Sprintf("%s-%s.json", p.Name, p.ID)))
+	if err := os.MkdirAll(filepath.Join(dir, storage.PlaylistsDir), 0o755); err != nil {
+		return "", err
+	}
+	if err := storage.WriteJSONFile(filepath.Join(dir, rel), p); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// ExportHistory writes the canonical history file.
+func (JSON) ExportHistory(dir string, h *storage.History) (string, error) {
+	rel := filepath.Join(storage.HistoryDir, storage.HistoryFile)
+	if err := os.MkdirAll(filepath.Join(dir, storage.HistoryDir), 0o755); err != nil {
+		return "", err
+	}
+	if err := storage.WriteJSONFile(filepath.Join(dir, rel), h); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
@@ -0,0 +1,143 @@
+// Package metrics holds the Prometheus collectors of spotify-backup, served
+// at /metrics in web mode.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "spotify_backup"
+
+var (
+	BackupRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Backup runs by outcome (success, partial, interrupted, failed).",
+	}, []string{"outcome"})
+
+	BackupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of backup runs.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2h
+	})
+
+	LastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time the last fully successful backup finished.",
+	})
+
+	Playlists = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "playlists_total",
+		Help:      "Playlists backed up.",
+	})
+
+	Tracks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tracks_total",
+		Help:      "Track items of the playlists backed up.",
+	})
+
+	BytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_written_total",
+		Help:      "Bytes of playlist files, exports, images and index files written.",
+	})
+
+	APIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Requests to Spotify by endpoint and HTTP status (\"error\" if there was no response).",
+	}, []string{"endpoint", "status"})
+
+	APIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of requests to Spotify by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Responses from Spotify with status 429.",
+	})
+
+	Retries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Requests repeated after being rate limited.",
+	})
+
+	TokenRefreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refresh_failures_total",
+		Help:      "Failed attempts to refresh an access token.",
+	})
+)
+
+// Handler serves the collectors in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Transport wraps next, counting and timing every request by endpoint.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripper{next}
+}
+
+type roundTripper struct {
+	next http.RoundTripper
+}
+
+func (t roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	APIDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		APIRequests.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+	APIRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		RateLimited.Inc()
+	}
+	return resp, err
+}
+
+// idAfter lists the path segments that are followed by an ID.
+var idAfter = map[string]bool{"playlists": true, "users": true, "albums": true, "artists": true}
+
+// Endpoint turns a request path into a label with IDs replaced, e.g.
+// /v1/playlists/{id}/tracks. Anything outside the Web API and the token
+// endpoint, such as cover images, is reported as "download".
+func Endpoint(path string) string {
+	switch {
+	case path == "/api/token":
+		return path
+	case !strings.Contains(path+"/", "/v1/"):
+		return "download"
+	}
+	// keep any prefix of a stub server's base URL out of the label
+	path = path[strings.Index(path+"/", "/v1/"):]
+	segs := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for i := 2; i < len(segs); i++ {
+		if idAfter[segs[i-1]] {
+			segs[i] = "{id}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"spotify-backup/spotifytest"
+)
+
+func TestEndpoint(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v1/me":                           "/v1/me",
+		"/v1/me/playlists":                 "/v1/me/playlists",
+		"/v1/playlists/37i9dQZF1DX/":       "/v1/playlists/{id}",
+		"/v1/playlists/37i9dQZF1DX/tracks": "/v1/playlists/{id}/tracks",
+		"/v1/users/bob/playlists":          "/v1/users/{id}/playlists",
+		"/stub/v1/playlists/pl1/tracks":    "/v1/playlists/{id}/tracks",
+		"/api/token":                       "/api/token",
+		"/image/ab67616d0000b273":          "download",
+	} {
+		if got := Endpoint(path); got != want {
+			t.Errorf("Endpoint(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestTransportCountsRequests(t *testing.T) {
+	fx, err := spotifytest.LoadFixture("../testdata/account.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := spotifytest.NewServer(fx)
+	t.Cleanup(srv.Close)
+	client := srv.SpotifyClient()
+	client.HTTPClient.Transport = Transport(client.HTTPClient.Transport)
+
+	tracks := APIRequests.WithLabelValues("/v1/playlists/{id}/tracks", "200")
+	limited := APIRequests.WithLabelValues("/v1/playlists/{id}/tracks", "429")
+	okBefore, limitedBefore := testutil.ToFloat64(tracks), testutil.ToFloat64(limited)
+	rateLimitedBefore := testutil.ToFloat64(RateLimited)
+
+	srv.FailNext("/v1/playlists/pl1mine/tracks", http.StatusTooManyRequests, 2)
+	if _, err := client.FetchAllPlaylistTracks(context.Background(), srv.AccessToken, "pl1mine"); err != nil {
+		t.Fatal(err)
+	}
+	// 5 tracks in pages of 2
+	if got := testutil.ToFloat64(tracks) - okBefore; got != 3 {
+		t.Errorf("successful track page requests = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(limited) - limitedBefore; got != 2 {
+		t.Errorf("rate limited track page requests = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(RateLimited) - rateLimitedBefore; got != 2 {
+		t.Errorf("rate_limited_total grew by %v, want 2", got)
+	}
+}
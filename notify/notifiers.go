@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"spotify-backup/backup"
+)
+
+// Webhook posts a JSON document with the message and the full report.
+type Webhook struct {
+	URL    string
+	Client *http.Client // nil means http.DefaultClient
+}
+
+// WebhookPayload is the body posted by Webhook.
+type WebhookPayload struct {
+	Title   string         `json:"title"`
+	Message string         `json:"message"`
+	Outcome string         `json:"outcome"`
+	Report  *backup.Report `json:"report"`
+}
+
+func (w Webhook) Name() string { return "webhook" }
+
+func (w Webhook) Notify(ctx context.Context, msg Message) error {
+	b, err := json.Marshal(WebhookPayload{Title: msg.Title, Message: msg.Body, Outcome: msg.Report.Outcome, Report: msg.Report})
+	if err != nil {
+		return err
+	}
+	return post(ctx, w.Client, w.URL, b, http.Header{"Content-Type": {"application/json"}})
+}
+
+// Ntfy publishes to an ntfy topic URL such as https://ntfy.sh/my-backups.
+type Ntfy struct {
+	URL    string
+	Token  string // optional access token
+	Client *http.Client
+}
+
+func (n Ntfy) Name() string { return "ntfy" }
+
+func (n Ntfy) Notify(ctx context.Context, msg Message) error {
+	h := http.Header{
+		"Title":        {msg.Title},
+		"Content-Type": {"text/plain; charset=utf-8"},
+	}
+	if msg.Failed {
+		h.Set("Priority", "high")
+		h.Set("Tags", "warning")
+	} else {
+		h.Set("Tags", "white_check_mark")
+	}
+	if n.Token != "" {
+		h.Set("Authorization", "Bearer "+n.Token)
+	}
+	return post(ctx, n.Client, n.URL, []byte(msg.Body), h)
+}
+
+// Gotify sends to the /message endpoint of a Gotify server with an
+// application token.
+type Gotify struct {
+	URL    string // server base URL
+	Token  string
+	Client *http.Client
+}
+
+func (g Gotify) Name() string { return "gotify" }
+
+func (g Gotify) Notify(ctx context.Context, msg Message) error {
+	priority := 5
+	if msg.Failed {
+		priority = 8
+	}
+	b, err := json.Marshal(map[string]interface{}{"title": msg.Title, "message": msg.Body, "priority": priority})
+	if err != nil {
+		return err
+	}
+	u := strings.TrimRight(g.URL, "/") + "/message?token=" + url.QueryEscape(g.Token)
+	return post(ctx, g.Client, u, b, http.Header{"Content-Type": {"application/json"}})
+}
+
+// SMTP sends the message as a plain text email. Authentication is used when
+// Username is set; net/smtp only sends the password over TLS or to
+// localhost.
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (m SMTP) Name() string { return "smtp" }
+
+func (m SMTP) Notify(ctx context.Context, msg Message) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+	var a smtp.Auth
+	if m.Username != "" {
+		a = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Title)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	// smtp.SendMail has no context; give up waiting for it when ctx ends
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.Addr, a, m.From, m.To, []byte(b.String())) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
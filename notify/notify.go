@@ -0,0 +1,172 @@
+// Package notify sends the outcome of a backup run to a webhook, by email or
+// as a push notification through ntfy or Gotify.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"spotify-backup/backup"
+)
+
+// Notifier delivers one message.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, msg Message) error
+}
+
+// Message is a rendered notification. Report is the run it is about, for
+// notifiers that send structured data.
+type Message struct {
+	Title  string
+	Body   string
+	Failed bool // the run didn't back up everything
+	Report *backup.Report
+}
+
+// DefaultTemplate renders the body of a message from a *backup.Report.
+const DefaultTemplate = `{{.BackedUp}} of {{.Selected}} playlists backed up ({{.Outcome}}).
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}
+{{- with .Failures}}
+
+Failures:
+{{- range .}}
+- {{.Stage}} of {{if .Name}}{{.Name}}{{else}}{{.PlaylistID}}{{end}}: {{.Error}}
+{{- end}}
+{{- end}}
+{{- with .Warnings}}
+
+Warnings:
+{{- range .}}
+- {{.Stage}} of {{if .Name}}{{.Name}}{{else}}{{.PlaylistID}}{{end}}: {{.Error}}
+{{- end}}
+{{- end}}
+{{- with .CountMismatches}}
+
+Incomplete playlists:
+{{- range .}}
+- {{.Name}}: {{.Tracks}} of {{.TracksTotal}} tracks
+{{- end}}
+{{- end}}
+{{- with .Changes}}{{if not .Empty}}
+
+Changes:
+{{- range .Added}}
++ {{.}}
+{{- end}}
+{{- range .Removed}}
+- {{.}}
+{{- end}}
+{{- range .Tracks}}
+~ {{.Name}}: {{.Before}} -> {{.After}} tracks
+{{- end}}
+{{- end}}{{end}}
+`
+
+// Dispatcher renders the report of a run and hands it to every notifier.
+type Dispatcher struct {
+	Notifiers []Notifier
+	// OnlyFailures skips runs that backed up everything.
+	OnlyFailures bool
+	// Template overrides DefaultTemplate.
+	Template *template.Template
+	Logger   *slog.Logger
+}
+
+// ParseTemplate parses a message template; see DefaultTemplate.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("message").Parse(text)
+}
+
+// Send notifies about rep. Failing notifiers are logged and don't keep the
+// others from being tried; the first error is returned.
+func (d *Dispatcher) Send(ctx context.Context, rep *backup.Report) error {
+	if d == nil || len(d.Notifiers) == 0 || (d.OnlyFailures && rep.OK()) {
+		return nil
+	}
+	log := d.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	msg, err := d.render(rep)
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for _, n := range d.Notifiers {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := n.Notify(ctx, msg)
+		cancel()
+		if err != nil {
+			log.Warn("notification failed", "notifier", n.Name(), "err", err)
+			if first == nil {
+				first = fmt.Errorf("%s: %w", n.Name(), err)
+			}
+			continue
+		}
+		log.Debug("notification sent", "notifier", n.Name())
+	}
+	return first
+}
+
+func (d *Dispatcher) render(rep *backup.Report) (Message, error) {
+	tmpl := d.Template
+	if tmpl == nil {
+		tmpl = template.Must(ParseTemplate(DefaultTemplate))
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, rep); err != nil {
+		return Message{}, fmt.Errorf("render message: %w", err)
+	}
+	return Message{
+		Title:  title(rep.Outcome),
+		Body:   strings.TrimSpace(body.String()),
+		Failed: !rep.OK(),
+		Report: rep,
+	}, nil
+}
+
+func title(outcome string) string {
+	switch outcome {
+	case backup.OutcomeSuccess:
+		return "Spotify backup succeeded"
+	case backup.OutcomePartial:
+		return "Spotify backup finished with failures"
+	case backup.OutcomeInterrupted:
+		return "Spotify backup interrupted"
+	}
+	return "Spotify backup failed"
+}
+
+// post sends body to urlStr and treats any non-2xx status as an error.
+func post(ctx context.Context, client *http.Client, urlStr string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
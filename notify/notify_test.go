@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"spotify-backup/backup"
+	"spotify-backup/storage"
+)
+
+func partialReport() *backup.Report {
+	return &backup.Report{
+		StartedAt:  time.Now(),
+		FinishedAt: time.Now(),
+		Outcome:    backup.OutcomePartial,
+		Selected:   3,
+		BackedUp:   2,
+		Failures: []backup.Failure{
+			{PlaylistID: "pl2", Name: "Friday Mix", Stage: backup.StageTracks, Error: "unauthorized"},
+		},
+		CountMismatches: []storage.PlaylistCount{{ID: "pl3", Name: "Party", TracksTotal: 4, Tracks: 3}},
+		Changes: &backup.Changes{
+			Added:  []string{"Road Trip"},
+			Tracks: []backup.TrackChange{{ID: "pl3", Name: "Party", Before: 2, After: 3}},
+		},
+	}
+}
+
+// request is what a stub HTTP server received.
+type request struct {
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+func stubHTTP(t *testing.T) (*httptest.Server, <-chan request) {
+	t.Helper()
+	got := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- request{path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: string(b)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	msg, err := (&Dispatcher{}).render(partialReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Title != "Spotify backup finished with failures" || !msg.Failed {
+		t.Errorf("message = %+v", msg)
+	}
+	for _, want := range []string{
+		"2 of 3 playlists backed up (partial)",
+		"- tracks of Friday Mix: unauthorized",
+		"- Party: 3 of 4 tracks",
+		"+ Road Trip",
+		"~ Party: 2 -> 3 tracks",
+	} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("body lacks %q:\n%s", want, msg.Body)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	srv, got := stubHTTP(t)
+	d := &Dispatcher{Notifiers: []Notifier{Webhook{URL: srv.URL + "/hook"}}}
+	if err := d.Send(context.Background(), partialReport()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	var payload WebhookPayload
+	if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if r.path != "/hook" || payload.Outcome != backup.OutcomePartial || payload.Report.BackedUp != 2 || !strings.Contains(payload.Message, "Friday Mix") {
+		t.Errorf("webhook received %s %+v", r.path, payload)
+	}
+}
+
+func TestNtfyAndGotify(t *testing.T) {
+	ntfy, ntfyGot := stubHTTP(t)
+	gotify, gotifyGot := stubHTTP(t)
+	d := &Dispatcher{Notifiers: []Notifier{
+		Ntfy{URL: ntfy.URL + "/backups", Token: "tk_1"},
+		Gotify{URL: gotify.URL + "/", Token: "app-token"},
+	}}
+	if err := d.Send(context.Background(), partialReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-ntfyGot
+	if r.path != "/backups" || r.header.Get("Title") != "Spotify backup finished with failures" ||
+		r.header.Get("Priority") != "high" || r.header.Get("Authorization") != "Bearer tk_1" ||
+		!strings.Contains(r.body, "Friday Mix") {
+		t.Errorf("ntfy received %+v", r)
+	}
+
+	r = <-gotifyGot
+	var msg struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	json.Unmarshal([]byte(r.body), &msg)
+	if r.path != "/message" || r.query != "token=app-token" || msg.Priority != 8 || !strings.Contains(msg.Message, "Friday Mix") {
+		t.Errorf("gotify received %+v, %+v", r, msg)
+	}
+}
+
+func TestOnlyFailures(t *testing.T) {
+	srv, got := stubHTTP(t)
+	d := &Dispatcher{Notifiers: []Notifier{Webhook{URL: srv.URL}}, OnlyFailures: true}
+	if err := d.Send(context.Background(), &backup.Report{Outcome: backup.OutcomeSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-got:
+		t.Errorf("notified about a successful run: %+v", r)
+	default:
+	}
+}
+
+func TestFailingNotifierDoesNotStopOthers(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+	srv, got := stubHTTP(t)
+	d := &Dispatcher{Notifiers: []Notifier{Webhook{URL: broken.URL}, Ntfy{URL: srv.URL}}}
+	if err := d.Send(context.Background(), partialReport()); err == nil || !strings.Contains(err.Error(), "webhook") {
+		t.Errorf("err = %v, want the webhook failure", err)
+	}
+	select {
+	case <-got:
+	default:
+		t.Error("ntfy was not notified after the webhook failed")
+	}
+}
+
+// stubSMTP accepts one message and returns its envelope and data.
+func stubSMTP(t *testing.T) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		var transcript strings.Builder
+		reply("220 stub ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 stub")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				transcript.WriteString(line)
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					transcript.WriteString(l)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				ch <- transcript.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestSMTP(t *testing.T) {
+	addr, got := stubSMTP(t)
+	d := &Dispatcher{Notifiers: []Notifier{SMTP{Addr: addr, From: "backup@example.com", To: []string{"me@example.com"}}}}
+	if err := d.Send(context.Background(), partialReport()); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-got
+	for _, want := range []string{"<backup@example.com>", "<me@example.com>", "Subject: Spotify backup finished with failures", "Friday Mix"} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail lacks %q:\n%s", want, mail)
+		}
+	}
+}
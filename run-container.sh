@@ -1,19 +1,20 @@
 #!/usr/bin/env bash
 set -euo pipefail
 
-# Simple launcher for the spotify-backup container
+# Simple launcher for the spotify-backup container, which serves the web UI
 # Usage:
 #   ./run-container.sh [PORT]
 # Defaults:
-#   PORT=8888 (must match the port in SPOTIFY_REDIRECT_URI)
-# Required for first run (interactive OAuth):
+#   PORT=8080 (host port mapped to the web UI on 8080 in the container)
+# Spotify redirects back to /api/auth/callback on the address the UI is
+# opened by, e.g. http://127.0.0.1:8080/api/auth/callback; add that URI to
+# the Spotify app. Client credentials can be entered in the UI or set with
 #   export SPOTIFY_CLIENT_ID=... SPOTIFY_CLIENT_SECRET=...
-#   (Optionally override callback)
-#   export SPOTIFY_REDIRECT_URI=http://127.0.0.1:8888/callback
-# After first run a refresh token will be saved to ./.token and
-# you can omit client credentials for subsequent runs.
+#   (Optionally fix the callback, passed through unchanged)
+#   export SPOTIFY_REDIRECT_URI=https://backup.example/api/auth/callback
+# The refresh token is saved to ./.token and survives restarts.
 
-PORT=${1:-8888}
+PORT=${1:-8080}
 IMAGE=${IMAGE:-spotify-backup:latest}
 NAME=${NAME:-spotify-backup}
 
@@ -31,7 +32,7 @@ mkdir -p ./backup
 RUN_ARGS=(
   --rm -it
   --name "$NAME"
-  -p "$PORT:$PORT"
+  -p "$PORT:8080"
   -v "$PWD/.token:/data/.token"
   -v "$PWD/backup:/data/out"
 )
@@ -42,13 +43,8 @@ if [[ -n "${SPOTIFY_CLIENT_SECRET:-}" ]]; then RUN_ARGS+=( -e "SPOTIFY_CLIENT_SE
 if [[ -n "${SPOTIFY_ACCESS_TOKEN:-}" ]]; then RUN_ARGS+=( -e "SPOTIFY_ACCESS_TOKEN=$SPOTIFY_ACCESS_TOKEN" ); fi
 if [[ -n "${SPOTIFY_REFRESH_TOKEN:-}" ]]; then RUN_ARGS+=( -e "SPOTIFY_REFRESH_TOKEN=$SPOTIFY_REFRESH_TOKEN" ); fi
 
-# If user did not provide a redirect URI, set one that matches the mapped port
-if [[ -z "${SPOTIFY_REDIRECT_URI:-}" ]]; then
-  export SPOTIFY_REDIRECT_URI="http://127.0.0.1:${PORT}/callback"
-  RUN_ARGS+=( -e "SPOTIFY_REDIRECT_URI=$SPOTIFY_REDIRECT_URI" )
-else
-  RUN_ARGS+=( -e "SPOTIFY_REDIRECT_URI=$SPOTIFY_REDIRECT_URI" )
-fi
+# Without a redirect URI the server derives it from its own address
+if [[ -n "${SPOTIFY_REDIRECT_URI:-}" ]]; then RUN_ARGS+=( -e "SPOTIFY_REDIRECT_URI=$SPOTIFY_REDIRECT_URI" ); fi
 
 # Ensure OUT_DIR points to the mounted output dir inside the container
 RUN_ARGS+=( -e "OUT_DIR=/data/out" )
@@ -56,8 +52,9 @@ RUN_ARGS+=( -e "OUT_DIR=/data/out" )
 # Info message
 cat <<EOF
 [i] Running $IMAGE as $NAME
-    OAuth callback: $SPOTIFY_REDIRECT_URI
-    Mapped port:    $PORT:$PORT
+    Web UI:         http://127.0.0.1:$PORT
+    OAuth callback: ${SPOTIFY_REDIRECT_URI:-http://127.0.0.1:$PORT/api/auth/callback}
+    Mapped port:    $PORT:8080
     Token file:     $PWD/.token
     Output dir:     $PWD/backup
 EOF
@@ -0,0 +1,278 @@
+// Package scheduler runs backups periodically in web mode, on a cron
+// expression or a fixed interval. The schedule and the time of the last run
+// are persisted so a run missed while the server was down is caught up.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"spotify-backup/storage"
+)
+
+// MinInterval is the shortest interval accepted, to stay clear of Spotify's
+// rate limits.
+var MinInterval = time.Minute
+
+// Config is the schedule set through the API. Exactly one of Cron and
+// Interval is set when Enabled.
+type Config struct {
+	Enabled  bool   `json:"enabled"`
+	Cron     string `json:"cron,omitempty"`     // standard 5-field expression, e.g. "0 3 * * *"
+	Interval string `json:"interval,omitempty"` // Go duration, e.g. "12h"
+}
+
+// Status is the schedule as reported by the API.
+type Status struct {
+	Config
+	NextRun     *time.Time `json:"nextRun,omitempty"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastOutcome string     `json:"lastOutcome,omitempty"`
+	Running     bool       `json:"running"`
+}
+
+// RunFunc performs one backup and returns its outcome.
+type RunFunc func(ctx context.Context, trigger string) (outcome string)
+
+// Triggers passed to RunFunc.
+const (
+	TriggerSchedule = "schedule"
+	TriggerCatchUp  = "catch-up" // a scheduled run missed while the server was down
+	TriggerManual   = "manual"
+)
+
+// saved is the content of the schedule file.
+type saved struct {
+	Config
+	LastRun     time.Time `json:"lastRun"`
+	LastOutcome string    `json:"lastOutcome,omitempty"`
+}
+
+// Scheduler triggers RunFunc according to its Config, never running two
+// backups at once.
+type Scheduler struct {
+	file   string
+	run    RunFunc
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	cfg         Config
+	sched       cron.Schedule // nil when disabled
+	next        time.Time
+	lastRun     time.Time
+	lastOutcome string
+	running     bool
+	stopped     bool // Start returned; no backup is started any more
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New loads the schedule persisted in file, if any. A missing file means no
+// schedule.
+func New(file string, run RunFunc, logger *slog.Logger) (*Scheduler, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Scheduler{file: file, run: run, logger: logger, wake: make(chan struct{}, 1)}
+
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st saved
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", file, err)
+	}
+	sched, err := parse(st.Config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	s.cfg, s.sched = st.Config, sched
+	s.lastRun, s.lastOutcome = st.LastRun, st.LastOutcome
+	if sched != nil {
+		// a next run that passed while we were down fires right away
+		from := st.LastRun
+		if from.IsZero() {
+			from = time.Now()
+		}
+		s.next = sched.Next(from)
+	}
+	return s, nil
+}
+
+// parse validates cfg and returns its schedule, or nil if it is disabled.
+func parse(cfg Config) (cron.Schedule, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	switch {
+	case cfg.Cron != "" && cfg.Interval != "":
+		return nil, errors.New("set either cron or interval, not both")
+	case cfg.Cron != "":
+		sched, err := cron.ParseStandard(cfg.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("cron: %w", err)
+		}
+		return sched, nil
+	case cfg.Interval != "":
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("interval: %w", err)
+		}
+		if d < MinInterval {
+			return nil, fmt.Errorf("interval: must be at least %s", MinInterval)
+		}
+		return every(d), nil
+	}
+	return nil, errors.New("set cron or interval")
+}
+
+// every is a fixed interval; unlike cron.Every it isn't rounded to seconds.
+type every time.Duration
+
+func (d every) Next(t time.Time) time.Time { return t.Add(time.Duration(d)) }
+
+// Set replaces the schedule and persists it. The next run is computed from
+// now, so changing the schedule doesn't trigger a catch-up.
+func (s *Scheduler) Set(cfg Config) error {
+	sched, err := parse(cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cfg, s.sched = cfg, sched
+	s.next = time.Time{}
+	if sched != nil {
+		s.next = sched.Next(time.Now())
+	}
+	err = s.save()
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// Status reports the schedule and the last and next runs.
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{Config: s.cfg, LastOutcome: s.lastOutcome, Running: s.running}
+	if !s.next.IsZero() {
+		next := s.next
+		st.NextRun = &next
+	}
+	if !s.lastRun.IsZero() {
+		last := s.lastRun
+		st.LastRun = &last
+	}
+	return st
+}
+
+// Start runs the schedule until ctx is cancelled, then waits for a backup
+// in progress to wind down. RunNow starts nothing once Start has returned.
+func (s *Scheduler) Start(ctx context.Context) {
+	defer func() {
+		// stop under s.mu so no RunNow adds to s.wg while we wait on it
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
+		s.wg.Wait()
+	}()
+	for {
+		s.mu.Lock()
+		next := s.next
+		catchUp := !next.IsZero() && !s.lastRun.IsZero() && next.Before(time.Now())
+		s.mu.Unlock()
+
+		var fire <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+		fired := false
+		select {
+		case <-ctx.Done():
+		case <-s.wake: // the schedule changed
+		case <-fire:
+			fired = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !fired {
+			continue
+		}
+
+		trigger := TriggerSchedule
+		if catchUp {
+			trigger = TriggerCatchUp
+		}
+		s.mu.Lock()
+		if s.sched != nil {
+			s.next = s.sched.Next(time.Now())
+		}
+		s.mu.Unlock()
+		if !s.RunNow(ctx, trigger) {
+			s.logger.Warn("skipping scheduled backup, the previous one is still running")
+		}
+	}
+}
+
+// RunNow starts a backup in the background unless one is already running
+// or the scheduler has stopped, and reports whether it started.
+func (s *Scheduler) RunNow(ctx context.Context, trigger string) bool {
+	s.mu.Lock()
+	if s.running || s.stopped {
+		s.mu.Unlock()
+		return false
+	}
+	s.running = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	started := time.Now().UTC()
+	go func() {
+		defer s.wg.Done()
+		s.logger.Info("starting backup", "trigger", trigger)
+		outcome := s.run(ctx, trigger)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = false
+		s.lastRun, s.lastOutcome = started, outcome
+		if err := s.save(); err != nil {
+			s.logger.Warn("failed to save schedule", "file", s.file, "err", err)
+		}
+	}()
+	return true
+}
+
+// Wait blocks until a backup in progress has finished.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// save persists the schedule; s.mu must be held.
+func (s *Scheduler) save() error {
+	return storage.WriteJSONFile(s.file, saved{Config: s.cfg, LastRun: s.lastRun, LastOutcome: s.lastOutcome})
+}
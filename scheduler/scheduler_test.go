@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"spotify-backup/storage"
+)
+
+func init() {
+	MinInterval = time.Millisecond
+}
+
+// recorder is a RunFunc reporting each trigger on a channel.
+type recorder struct {
+	runs    chan string
+	release chan struct{} // if set, runs block until it is closed
+}
+
+func newRecorder() *recorder {
+	return &recorder{runs: make(chan string, 10)}
+}
+
+func (r *recorder) run(ctx context.Context, trigger string) string {
+	r.runs <- trigger
+	if r.release != nil {
+		<-r.release
+	}
+	return "success"
+}
+
+func (r *recorder) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case trigger := <-r.runs:
+		return trigger
+	case <-time.After(5 * time.Second):
+		t.Fatal("no backup was started")
+		return ""
+	}
+}
+
+func TestIntervalScheduleRunsAndPersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schedule.json")
+	rec := newRecorder()
+	s, err := New(file, rec.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { s.Start(ctx); close(done) }()
+
+	if err := s.Set(Config{Enabled: true, Interval: "20ms"}); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.NextRun == nil {
+		t.Errorf("status = %+v, want a next run", st)
+	}
+	if trigger := rec.wait(t); trigger != TriggerSchedule {
+		t.Errorf("trigger = %q, want %q", trigger, TriggerSchedule)
+	}
+	cancel()
+	<-done
+
+	reloaded, err := New(file, rec.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := reloaded.Status()
+	if !st.Enabled || st.Interval != "20ms" || st.LastRun == nil || st.LastOutcome != "success" {
+		t.Errorf("reloaded status = %+v, want the saved schedule and last run", st)
+	}
+}
+
+func TestOverlappingRunsAreSkipped(t *testing.T) {
+	rec := newRecorder()
+	rec.release = make(chan struct{})
+	s, err := New(filepath.Join(t.TempDir(), "schedule.json"), rec.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.RunNow(context.Background(), TriggerManual) {
+		t.Fatal("first run did not start")
+	}
+	rec.wait(t)
+	if !s.Status().Running {
+		t.Error("status does not report the running backup")
+	}
+	if s.RunNow(context.Background(), TriggerManual) {
+		t.Error("second run started while the first was running")
+	}
+	close(rec.release)
+	s.Wait()
+	if s.RunNow(context.Background(), TriggerManual) {
+		rec.wait(t)
+		s.Wait()
+	} else {
+		t.Error("run did not start after the previous one finished")
+	}
+}
+
+func TestNoRunsAfterStop(t *testing.T) {
+	rec := newRecorder()
+	s, err := New(filepath.Join(t.TempDir(), "schedule.json"), rec.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { s.Start(ctx); close(done) }()
+	cancel()
+	<-done
+
+	if s.RunNow(context.Background(), TriggerManual) {
+		t.Error("run started after the scheduler stopped")
+		s.Wait()
+	}
+	if s.Status().Running {
+		t.Error("status reports a running backup after the scheduler stopped")
+	}
+}
+
+func TestMissedRunIsCaughtUp(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schedule.json")
+	err := storage.WriteJSONFile(file, saved{
+		Config:      Config{Enabled: true, Cron: "0 3 * * *"},
+		LastRun:     time.Now().Add(-48 * time.Hour),
+		LastOutcome: "success",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newRecorder()
+	s, err := New(file, rec.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+
+	if trigger := rec.wait(t); trigger != TriggerCatchUp {
+		t.Errorf("trigger = %q, want %q", trigger, TriggerCatchUp)
+	}
+	s.Wait()
+	if next := s.Status().NextRun; next == nil || !next.After(time.Now()) {
+		t.Errorf("next run = %v, want one in the future after catching up", next)
+	}
+	select {
+	case trigger := <-rec.runs:
+		t.Errorf("caught up more than once (%s)", trigger)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSetRejectsInvalidSchedules(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "schedule.json"), newRecorder().run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []Config{
+		{Enabled: true},
+		{Enabled: true, Cron: "not a cron"},
+		{Enabled: true, Interval: "daily"},
+		{Enabled: true, Cron: "0 3 * * *", Interval: "1h"},
+	} {
+		if err := s.Set(cfg); err == nil {
+			t.Errorf("Set(%+v) succeeded, want an error", cfg)
+		}
+	}
+	if err := s.Set(Config{Enabled: false}); err != nil {
+		t.Errorf("disabling: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"spotify-backup/backup"
+	"spotify-backup/metrics"
+	"spotify-backup/scheduler"
+	"spotify-backup/spotify"
+)
+
+// runBackup is the RunFunc of a user's scheduler: it backs up with their
+// options and a fresh access token.
+func (s *Server) runBackup(ctx context.Context, u *user, trigger string) string {
+	log := s.logger.With("user", u.name, "job", trigger+"-"+time.Now().UTC().Format("20060102T150405Z"))
+	token, err := s.freshAccessToken(ctx, u)
+	if err != nil {
+		log.Error("backup not started", "err", err)
+		metrics.BackupRuns.WithLabelValues(backup.OutcomeFailed).Inc()
+		now := time.Now().UTC()
+		s.notify(ctx, log, &backup.Report{StartedAt: now, FinishedAt: now, Outcome: backup.OutcomeFailed, Error: err.Error()})
+		return backup.OutcomeFailed
+	}
+
+	opts := u.backup
+	opts.Client = s.api
+	opts.AccessToken = token
+	opts.Logger = log
+	// continue where a run cut short by a restart stopped
+	opts.Resume = true
+	res, err := backup.Backup(ctx, opts)
+	if err != nil {
+		log.Error("backup failed", "err", err)
+	}
+	log.Info("backup finished", "outcome", res.Report.Outcome)
+	s.notify(ctx, log, res.Report)
+	return res.Report.Outcome
+}
+
+// notify sends the report, even when the run was cut short by a shutdown.
+func (s *Server) notify(ctx context.Context, log *slog.Logger, rep *backup.Report) {
+	if s.notifier == nil {
+		return
+	}
+	d := *s.notifier
+	d.Logger = log
+	d.Send(context.WithoutCancel(ctx), rep)
+}
+
+// freshAccessToken refreshes the user's access token if a refresh token is
+// available, since a stored access token expires after an hour.
+func (s *Server) freshAccessToken(ctx context.Context, u *user) (string, error) {
+	cred := u.state.Credentials()
+	access, refresh := u.state.Tokens()
+	if refresh != "" && cred.ClientID != "" && cred.ClientSecret != "" {
+		tok, err := s.api.RefreshAccessToken(ctx, cred.ClientID, cred.ClientSecret, refresh)
+		if err != nil {
+			metrics.TokenRefreshFailures.Inc()
+			return "", err
+		}
+		u.state.SetAccessToken(tok.AccessToken, tok.Scope)
+		return tok.AccessToken, nil
+	}
+	if access != "" {
+		return access, nil
+	}
+	return "", errors.New("not authenticated with Spotify")
+}
+
+// withAccessToken calls f with the user's access token, refreshing it first
+// if there is none and once more if the API rejects it as expired.
+func (s *Server) withAccessToken(ctx context.Context, u *user, f func(token string) error) error {
+	token, _ := u.state.Tokens()
+	if token == "" {
+		var err error
+		if token, err = s.freshAccessToken(ctx, u); err != nil {
+			return err
+		}
+	}
+	err := f(token)
+	if !errors.Is(err, spotify.ErrUnauthorized) {
+		return err
+	}
+	if _, refresh := u.state.Tokens(); refresh == "" {
+		return err
+	}
+	if token, err = s.freshAccessToken(ctx, u); err != nil {
+		return err
+	}
+	return f(token)
+}
+
+// handleGetSchedule reports the schedule with the last and next runs
+func (s *Server) handleGetSchedule(c *gin.Context) {
+	c.JSON(http.StatusOK, s.user(c).sched.Status())
+}
+
+// handleSetSchedule replaces the schedule
+func (s *Server) handleSetSchedule(c *gin.Context) {
+	var cfg scheduler.Config
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request: " + err.Error()})
+		return
+	}
+	sched := s.user(c).sched
+	if err := sched.Set(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid schedule: " + err.Error()})
+		return
+	}
+	s.log(c).Info("schedule changed", "enabled", cfg.Enabled, "cron", cfg.Cron, "interval", cfg.Interval)
+	c.JSON(http.StatusOK, sched.Status())
+}
+
+// handleStartBackup starts a backup right away unless one is running
+func (s *Server) handleStartBackup(c *gin.Context) {
+	u := s.user(c)
+	if !u.state.HasToken() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Not authenticated with Spotify"})
+		return
+	}
+	if !u.sched.RunNow(s.baseCtx, scheduler.TriggerManual) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "A backup is already running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Backup started"})
+}
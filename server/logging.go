@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	loggerKey       = "logger"
+)
+
+// validRequestID limits which client supplied IDs are passed on to the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID tags every request with an ID, reusing the one sent by a proxy
+// if there is one, and stores a logger carrying it in the gin context.
+func (s *Server) requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Header(requestIDHeader, id)
+	c.Set(loggerKey, s.logger.With("request_id", id))
+	c.Next()
+}
+
+// accessLog logs each request once it has been handled.
+func (s *Server) accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	level := slog.LevelInfo
+	switch {
+	case c.Writer.Status() >= 500:
+		level = slog.LevelError
+	case c.Request.URL.Path == "/metrics":
+		level = slog.LevelDebug // scraped every few seconds
+	}
+	s.log(c).Log(c.Request.Context(), level, "request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"client_ip", c.ClientIP(),
+	)
+}
+
+// log returns the request's logger.
+func (s *Server) log(c *gin.Context) *slog.Logger {
+	if l, ok := c.Get(loggerKey); ok {
+		return l.(*slog.Logger)
+	}
+	return s.logger
+}
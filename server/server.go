@@ -0,0 +1,517 @@
+// Package server is the web mode front-end: a gin server backing the
+// Angular UI with the Spotify authorization flow.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+
+	"spotify-backup/auth"
+	"spotify-backup/backup"
+	"spotify-backup/metrics"
+	"spotify-backup/notify"
+	"spotify-backup/spotify"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// Config holds the settings of a web server.
+type Config struct {
+	Client       *spotify.Client
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	TokenFile    string       // where the refresh token of the admin user is persisted
+	PublicDir    string       // built Angular UI, served at /
+	Logger       *slog.Logger // nil means slog.Default()
+	// Backup holds the settings of scheduled and manual backups; the
+	// client and access token are filled in for every run.
+	Backup       backup.Options
+	ScheduleFile string             // where the schedule of the admin user is persisted
+	SettingsFile string             // where the admin user's Settings are saved when changed in the UI
+	Notifier     *notify.Dispatcher // told about every backup run; may be nil
+	// AdminPassword logs the UI in as the admin user; APIToken is accepted
+	// as a bearer token for it by scripts. With no password, token or
+	// other users a random password is generated and printed to stderr.
+	AdminPassword string
+	APIToken      string
+	// Users are further accounts, by name, with their password; see
+	// ReadUsersFile. Each links their own Spotify account and keeps their
+	// token, schedule and backups in a directory of their own in UsersDir.
+	Users    map[string]string
+	UsersDir string
+}
+
+// Server serves the API and UI of web mode.
+type Server struct {
+	api       *spotify.Client
+	publicDir string
+	logger    *slog.Logger
+	notifier  *notify.Dispatcher
+	baseCtx   context.Context // backups outlive the request that started them
+
+	// defaults are the settings new users start with
+	defaults struct {
+		credentials Credentials
+		backup      backup.Options
+	}
+
+	apiToken   string
+	users      map[string]*user // fixed at startup
+	sessions   *sessionStore
+	authStates *authStates
+}
+
+// New creates a server, picking up the refresh tokens saved by an earlier
+// run and the persisted schedules.
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		api:       cfg.Client,
+		publicDir: cfg.PublicDir,
+		logger:    cfg.Logger,
+		notifier:  cfg.Notifier,
+		baseCtx:   context.Background(),
+
+		apiToken:   cfg.APIToken,
+		users:      make(map[string]*user),
+		sessions:   newSessionStore(),
+		authStates: newAuthStates(),
+	}
+	s.defaults.credentials = Credentials{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURI:  cfg.RedirectURI,
+	}
+	s.defaults.backup = cfg.Backup
+	if s.publicDir == "" {
+		s.publicDir = "public"
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	password := cfg.AdminPassword
+	if p, ok := cfg.Users[defaultUser]; ok {
+		if password != "" {
+			return nil, fmt.Errorf("the password of %s is set twice", defaultUser)
+		}
+		password = p
+	}
+	if password == "" && s.apiToken == "" && len(cfg.Users) == 0 {
+		password = randomToken()[:16]
+		// not logged, so it doesn't end up in log files and aggregators
+		s.logger.Warn("no admin password or API token configured, generated a password for this run and printed it to stderr")
+		fmt.Fprintf(os.Stderr, "\n%[1]s\n  Admin password for this run: %[2]s\n  Set an admin password or API token to choose your own.\n%[1]s\n\n", strings.Repeat("=", 60), password)
+	}
+	admin := &user{
+		name:         defaultUser,
+		password:     password,
+		tokenFile:    cfg.TokenFile,
+		settingsFile: cfg.SettingsFile,
+		backup:       cfg.Backup,
+	}
+	if err := s.addUser(admin, cfg.ScheduleFile); err != nil {
+		return nil, err
+	}
+
+	for name, password := range cfg.Users {
+		if name == defaultUser {
+			continue
+		}
+		if cfg.UsersDir == "" {
+			return nil, errors.New("no directory for the files of users")
+		}
+		u, scheduleFile, err := s.newUser(name, password, cfg.UsersDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.addUser(u, scheduleFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Run serves on addr and runs scheduled backups until the listener fails or
+// ctx is cancelled. On cancellation in-flight requests get up to
+// shutdownTimeout to complete and running backups save what they have.
+func (s *Server) Run(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.baseCtx = ctx
+	var schedulers sync.WaitGroup
+	for _, u := range s.users {
+		schedulers.Add(1)
+		go func() {
+			defer schedulers.Done()
+			u.sched.Start(ctx)
+		}()
+	}
+	// also when the listener fails, stop the schedulers and wait for backups
+	defer func() {
+		cancel()
+		schedulers.Wait()
+	}()
+
+	mime.AddExtensionType(".js", "text/javascript")
+	mime.AddExtensionType(".mjs", "text/javascript")
+	mime.AddExtensionType(".css", "text/css")
+	mime.AddExtensionType(".wasm", "application/wasm")
+
+	gin.SetMode(gin.ReleaseMode)
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+	s.logger.Info("shutting down web server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// Handler builds the gin engine serving the API and the Angular UI.
+func (s *Server) Handler() *gin.Engine {
+	r := gin.New()
+	r.Use(s.requestID, s.accessLog, gin.Recovery())
+
+	r.Use(cors.New(cors.Config{
+		AllowOrigins:     []string{"http://localhost:4200", "http://localhost:8080"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", requestIDHeader, "Authorization", csrfHeader},
+		ExposeHeaders:    []string{requestIDHeader, csrfHeader},
+		AllowCredentials: true,
+	}))
+
+	// unauthenticated for scrapers; it reveals run times and counts, so it
+	// must not be reachable from the public internet
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// Spotify redirects the browser to the callback without our session,
+	// and logging in can't require being logged in.
+	public := r.Group("/api")
+	{
+		public.GET("/auth/callback", s.handleAuthCallback) // auth.CallbackPath
+		public.POST("/session", s.handleLogin)
+		public.GET("/session", s.handleGetSession)
+	}
+
+	api := r.Group("/api", s.requireAuth)
+	{
+		api.DELETE("/session", s.handleLogout)
+		api.GET("/status", s.handleStatus)
+		api.POST("/auth/setup", s.handleAuthSetup)
+		api.POST("/auth/start", s.handleAuthStart)
+		api.POST("/auth/logout", s.handleAuthLogout)
+		api.GET("/auth/me", s.handleAuthMe)
+		api.GET("/schedule", s.handleGetSchedule)
+		api.PUT("/schedule", s.handleSetSchedule)
+		api.POST("/backup", s.handleStartBackup)
+	}
+
+	// Serve favicon (if present)
+	r.StaticFile("/favicon.ico", filepath.Join(s.publicDir, "favicon.ico"))
+
+	// Explicit root route to serve the SPA entry
+	r.GET("/", func(c *gin.Context) {
+		c.File(filepath.Join(s.publicDir, "index.html"))
+	})
+
+	r.NoRoute(func(c *gin.Context) {
+		p := c.Request.URL.Path
+		if strings.HasPrefix(p, "/api") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+
+		clean := path.Clean(p)
+		if clean == "/" {
+			c.File(filepath.Join(s.publicDir, "index.html"))
+			return
+		}
+
+		local := filepath.Join(s.publicDir, strings.TrimPrefix(clean, "/"))
+		if info, err := os.Stat(local); err == nil && !info.IsDir() {
+			c.File(local)
+			return
+		}
+
+		c.File(filepath.Join(s.publicDir, "index.html"))
+	})
+
+	return r
+}
+
+// API Response types
+type StatusResponse struct {
+	HasToken    bool `json:"hasToken"`
+	HasClientID bool `json:"hasClientId"`
+	NeedsSetup  bool `json:"needsSetup"`
+	// TokenValid is set when Spotify accepted the token on this check
+	TokenValid bool `json:"tokenValid"`
+	// NeedsReauth asks the user to authorize again, because the token was
+	// rejected or lacks scopes
+	NeedsReauth bool     `json:"needsReauth"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// MissingScopes lists the scopes lacking, by feature
+	MissingScopes map[string][]string `json:"missingScopes,omitempty"`
+	Message       string              `json:"message"`
+}
+
+type AuthSetupRequest struct {
+	ClientID     string `json:"clientId" binding:"required"`
+	ClientSecret string `json:"clientSecret" binding:"required"`
+}
+
+type AuthSetupResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	AuthURL string `json:"authUrl,omitempty"`
+	// RedirectURI has to be allowed in the settings of the Spotify app
+	RedirectURI string `json:"redirectUri,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// tokenCheckInterval is how long a successful check of a token against
+// Spotify is trusted, so polling the status doesn't call Spotify every time.
+const tokenCheckInterval = time.Minute
+
+// handleStatus checks if there's a valid token or if setup is needed
+func (s *Server) handleStatus(c *gin.Context) {
+	u := s.user(c)
+	state := u.state
+	hasToken := state.HasToken()
+	hasClientID := state.Credentials().ClientID != ""
+
+	resp := StatusResponse{
+		HasToken:    hasToken,
+		HasClientID: hasClientID,
+		NeedsSetup:  !hasClientID,
+	}
+
+	if !hasClientID {
+		resp.Message = "Please provide Spotify client ID and secret to begin"
+	} else if !hasToken {
+		resp.Message = "Client credentials configured. Ready to authenticate with Spotify"
+	} else if err := s.checkToken(c.Request.Context(), u); err != nil {
+		s.log(c).Warn("token check failed", "err", err)
+		if errors.Is(err, spotify.ErrUnauthorized) || errors.Is(err, spotify.ErrInvalidGrant) {
+			resp.NeedsReauth = true
+			resp.Message = "Spotify rejected the stored token. Please authenticate again"
+		} else {
+			resp.Message = "Could not check the token with Spotify: " + err.Error()
+		}
+	} else {
+		resp.TokenValid = true
+		resp.Scopes = state.Scopes()
+		// scopes are unknown for a token loaded from disk and not refreshed
+		if resp.Scopes != nil {
+			if missing := auth.MissingScopes(resp.Scopes); len(missing) > 0 {
+				resp.MissingScopes = missing
+				resp.NeedsReauth = true
+			}
+		}
+		if resp.NeedsReauth {
+			resp.Message = "Some features need permissions not granted yet. Please authenticate again"
+		} else {
+			resp.Message = "Authentication complete. Ready to backup playlists"
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// checkToken makes sure Spotify accepts the user's token by fetching their
+// profile, refreshing the access token if needed.
+func (s *Server) checkToken(ctx context.Context, u *user) error {
+	if u.state.VerifiedWithin(tokenCheckInterval) {
+		return nil
+	}
+	err := s.withAccessToken(ctx, u, func(token string) error {
+		_, err := s.api.FetchCurrentUser(ctx, token)
+		return err
+	})
+	if err == nil {
+		u.state.MarkVerified()
+	}
+	return err
+}
+
+// handleAuthSetup receives client ID and secret from UI and initiates auth flow
+func (s *Server) handleAuthSetup(c *gin.Context) {
+	var req AuthSetupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request: " + err.Error()})
+		return
+	}
+
+	// Store credentials
+	u := s.user(c)
+	u.state.SetClient(req.ClientID, req.ClientSecret)
+	if err := s.saveCredentials(u); err != nil {
+		s.log(c).Warn("failed to save client credentials", "err", err)
+	}
+
+	// Generate auth URL
+	redirectURI := s.redirectURI(c, u)
+	authURL := s.api.AuthorizeURL(req.ClientID, redirectURI, auth.Scopes, s.authStates.begin(u.name, redirectURI))
+
+	c.JSON(http.StatusOK, AuthSetupResponse{
+		Success:     true,
+		Message:     "Client credentials saved. Please authorize the application",
+		AuthURL:     authURL,
+		RedirectURI: redirectURI,
+	})
+}
+
+// handleAuthStart initiates the OAuth flow
+func (s *Server) handleAuthStart(c *gin.Context) {
+	u := s.user(c)
+	cred := u.state.Credentials()
+	if cred.ClientID == "" || cred.ClientSecret == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Client credentials not configured"})
+		return
+	}
+
+	redirectURI := s.redirectURI(c, u)
+	authURL := s.api.AuthorizeURL(cred.ClientID, redirectURI, auth.Scopes, s.authStates.begin(u.name, redirectURI))
+
+	c.JSON(http.StatusOK, gin.H{
+		"authUrl":     authURL,
+		"redirectUri": redirectURI,
+		"message":     "Please visit the auth URL to authorize the application",
+	})
+}
+
+// redirectURI returns the configured redirect URI of the user, or else the
+// callback of this server at the address the browser used to reach it.
+func (s *Server) redirectURI(c *gin.Context, u *user) string {
+	if uri := u.state.Credentials().RedirectURI; uri != "" {
+		return uri
+	}
+	scheme := "http"
+	if isHTTPS(c) {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: c.Request.Host, Path: auth.CallbackPath}).String()
+}
+
+// handleAuthCallback receives the OAuth callback with authorization code,
+// for the user who started the authorization.
+func (s *Server) handleAuthCallback(c *gin.Context) {
+	auth.CallbackHandler(func(ctx context.Context, code, state string) error {
+		p, ok := s.authStates.finish(state)
+		if !ok {
+			return errors.New("unknown or expired authorization request")
+		}
+		u := s.users[p.user]
+		log := s.log(c).With("user", u.name)
+
+		// Exchange code for tokens
+		cred := u.state.Credentials()
+		out, err := s.api.ExchangeCode(ctx, cred.ClientID, cred.ClientSecret, code, p.redirectURI)
+		if err != nil {
+			log.Warn("code exchange failed", "err", err)
+			return err
+		}
+
+		// Store tokens
+		u.state.SetTokens(out.AccessToken, out.RefreshToken, out.Scope)
+
+		// Save refresh token to file
+		if err := auth.SaveRefreshToken(u.tokenFile, out.RefreshToken); err != nil {
+			log.Warn("failed to save refresh token", "err", err)
+		} else {
+			log.Info("refresh token saved", "file", u.tokenFile)
+		}
+		return nil
+	}).ServeHTTP(c.Writer, c.Request)
+}
+
+type LogoutRequest struct {
+	// ResetCredentials also forgets the client ID and secret
+	ResetCredentials bool `json:"resetCredentials"`
+}
+
+// handleAuthLogout disconnects the Spotify account: the tokens are
+// forgotten and the stored refresh token deleted.
+func (s *Server) handleAuthLogout(c *gin.Context) {
+	var req LogoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request: " + err.Error()})
+			return
+		}
+	}
+
+	u := s.user(c)
+	u.state.Logout(req.ResetCredentials)
+	if err := auth.DeleteRefreshToken(u.tokenFile); err != nil {
+		s.log(c).Error("failed to delete refresh token", "file", u.tokenFile, "err", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete the stored refresh token"})
+		return
+	}
+	if req.ResetCredentials {
+		if err := s.saveCredentials(u); err != nil {
+			s.log(c).Warn("failed to save client credentials", "err", err)
+		}
+	}
+	s.log(c).Info("disconnected Spotify account", "reset_credentials", req.ResetCredentials)
+
+	c.JSON(http.StatusOK, AuthSetupResponse{
+		Success: true,
+		Message: "Disconnected from Spotify",
+	})
+}
+
+type MeResponse struct {
+	ID          string   `json:"id"`
+	DisplayName string   `json:"displayName"`
+	Scopes      []string `json:"scopes"` // empty if not known yet
+}
+
+// handleAuthMe returns the profile of the linked Spotify account
+func (s *Server) handleAuthMe(c *gin.Context) {
+	u := s.user(c)
+	if !u.state.HasToken() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Not authenticated with Spotify"})
+		return
+	}
+	var me *spotify.User
+	err := s.withAccessToken(c.Request.Context(), u, func(token string) error {
+		var err error
+		me, err = s.api.FetchCurrentUser(c.Request.Context(), token)
+		return err
+	})
+	if err != nil {
+		s.log(c).Warn("failed to fetch Spotify profile", "err", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to fetch the Spotify profile: " + err.Error()})
+		return
+	}
+	scopes := u.state.Scopes()
+	if scopes == nil {
+		scopes = []string{}
+	}
+	c.JSON(http.StatusOK, MeResponse{ID: me.ID, DisplayName: me.DisplayName, Scopes: scopes})
+}
@@ -0,0 +1,685 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"spotify-backup/auth"
+	"spotify-backup/backup"
+	"spotify-backup/scheduler"
+	"spotify-backup/spotify"
+	"spotify-backup/spotifytest"
+	"spotify-backup/storage"
+)
+
+// testToken is the API token of test servers without other credentials.
+const testToken = "test-token"
+
+// newTestServer creates a server keeping its files in a temporary directory.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	if cfg.AdminPassword == "" && cfg.APIToken == "" {
+		cfg.APIToken = testToken
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = filepath.Join(dir, ".token")
+	}
+	if cfg.ScheduleFile == "" {
+		cfg.ScheduleFile = filepath.Join(dir, "schedule.json")
+	}
+	if cfg.SettingsFile == "" {
+		cfg.SettingsFile = filepath.Join(dir, SettingsFile)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newFakeSpotify starts a fake Spotify API serving the test account.
+func newFakeSpotify(t *testing.T) *spotifytest.Server {
+	t.Helper()
+	fx, err := spotifytest.LoadFixture("../testdata/account.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := spotifytest.NewServer(fx)
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// requester returns a function sending a request with body, if any, as JSON
+// to h. Headers are name and value pairs; the ones given here are sent with
+// every request, before the ones given with it.
+func requester(h http.Handler, header ...string) func(method, target string, body any, header ...string) *httptest.ResponseRecorder {
+	return func(method, target string, body any, extra ...string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, target, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		all := append(slices.Clip(header), extra...)
+		for i := 0; i+1 < len(all); i += 2 {
+			req.Header.Set(all[i], all[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+}
+
+// withToken is the header authenticating with the test API token.
+var withToken = []string{"Authorization", "Bearer " + testToken}
+
+// authorize follows authURL like a browser would, stopping at the redirect,
+// and returns the callback URL Spotify sends the browser to.
+func authorize(authURL string) (*url.URL, error) {
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(authURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return url.Parse(resp.Header.Get("Location"))
+}
+
+func TestWebAuthFlow(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	tokenFile := filepath.Join(t.TempDir(), ".token")
+	s := newTestServer(t, Config{
+		Client:      fake.SpotifyClient(),
+		RedirectURI: "http://localhost:8080/api/auth/callback",
+		TokenFile:   tokenFile,
+	})
+	do := requester(s.Handler(), withToken...)
+
+	var status StatusResponse
+	json.Unmarshal(do("GET", "/api/status", nil).Body.Bytes(), &status)
+	if !status.NeedsSetup {
+		t.Fatalf("status = %+v, want needsSetup", status)
+	}
+
+	w := do("POST", "/api/auth/setup", AuthSetupRequest{ClientID: fake.ClientID, ClientSecret: fake.ClientSecret})
+	var setup AuthSetupResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &setup); err != nil || !setup.Success {
+		t.Fatalf("setup failed: %d %s", w.Code, w.Body)
+	}
+
+	callback, err := authorize(setup.AuthURL)
+	if err != nil || callback.Query().Get("code") == "" {
+		t.Fatalf("authorize redirect = %v, %v", callback, err)
+	}
+
+	if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	json.Unmarshal(do("GET", "/api/status", nil).Body.Bytes(), &status)
+	if !status.HasToken {
+		t.Errorf("status = %+v, want hasToken after callback", status)
+	}
+	if rt, err := auth.LoadRefreshToken(tokenFile); err != nil || rt != fake.RefreshToken {
+		t.Errorf("stored refresh token = %q, %v", rt, err)
+	}
+}
+
+func TestRedirectURIFromServerAddress(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	s := newTestServer(t, Config{Client: fake.SpotifyClient()})
+	// as reached through a reverse proxy terminating TLS
+	api := requester(s.Handler(), append(withToken, "X-Forwarded-Proto", "https")...)
+	do := func(method, target string, body any) *httptest.ResponseRecorder {
+		return api(method, "http://backup.example:8443"+target, body)
+	}
+
+	var setup AuthSetupResponse
+	w := do("POST", "/api/auth/setup", AuthSetupRequest{ClientID: fake.ClientID, ClientSecret: fake.ClientSecret})
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	if want := "https://backup.example:8443" + auth.CallbackPath; setup.RedirectURI != want {
+		t.Fatalf("redirect URI = %q, want %q", setup.RedirectURI, want)
+	}
+
+	callback, err := authorize(setup.AuthURL)
+	if err != nil || callback.Path != auth.CallbackPath {
+		t.Fatalf("authorize redirect = %v, %v; want the callback", callback, err)
+	}
+	// the fake only exchanges the code with the redirect URI it was issued for
+	if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+
+	if w := do("GET", auth.CallbackPath+"?error=access_denied", nil); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "access_denied") {
+		t.Errorf("denied callback: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIRequiresAuth(t *testing.T) {
+	s := newTestServer(t, Config{
+		Client:        spotify.NewClient(),
+		AdminPassword: "hunter2",
+		APIToken:      "script-token",
+	})
+	do := requester(s.Handler())
+	setup := AuthSetupRequest{ClientID: "attacker", ClientSecret: "secret"}
+
+	for _, tc := range []struct {
+		method, target string
+		body           any
+	}{
+		{"GET", "/api/status", nil},
+		{"POST", "/api/auth/setup", setup},
+		{"POST", "/api/auth/start", nil},
+		{"GET", "/api/schedule", nil},
+		{"PUT", "/api/schedule", scheduler.Config{}},
+		{"POST", "/api/backup", nil},
+	} {
+		if w := do(tc.method, tc.target, tc.body); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without credentials: %d, want 401", tc.method, tc.target, w.Code)
+		}
+	}
+	if w := do("GET", "/api/status", nil, "Authorization", "Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong API token: %d, want 401", w.Code)
+	}
+	if w := do("GET", "/api/status", nil, "Authorization", "Bearer script-token"); w.Code != http.StatusOK {
+		t.Errorf("API token: %d, want 200", w.Code)
+	}
+	if w := do("GET", "/api/auth/callback", nil); w.Code == http.StatusUnauthorized {
+		t.Error("the OAuth callback requires a login")
+	}
+
+	if w := do("POST", "/api/session", LoginRequest{Password: "hunter"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", w.Code)
+	}
+	w := do("POST", "/api/session", LoginRequest{Password: "hunter2"})
+	var sess SessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil || w.Code != http.StatusOK || sess.CSRFToken == "" {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != sessionCookie || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie = %+v", cookie)
+	}
+	withCookie := cookie.Name + "=" + cookie.Value
+
+	if w := do("GET", "/api/status", nil, "Cookie", withCookie); w.Code != http.StatusOK {
+		t.Errorf("GET with session: %d, want 200", w.Code)
+	}
+	if w := do("POST", "/api/auth/setup", setup, "Cookie", withCookie); w.Code != http.StatusForbidden {
+		t.Errorf("POST without CSRF token: %d, want 403", w.Code)
+	}
+	if w := do("POST", "/api/auth/setup", setup, "Cookie", withCookie, "X-CSRF-Token", "forged"); w.Code != http.StatusForbidden {
+		t.Errorf("POST with a wrong CSRF token: %d, want 403", w.Code)
+	}
+	if w := do("POST", "/api/auth/setup", setup, "Cookie", withCookie, "X-CSRF-Token", sess.CSRFToken); w.Code != http.StatusOK {
+		t.Errorf("POST with CSRF token: %d %s", w.Code, w.Body)
+	}
+
+	var again SessionResponse
+	json.Unmarshal(do("GET", "/api/session", nil, "Cookie", withCookie).Body.Bytes(), &again)
+	if again.CSRFToken != sess.CSRFToken {
+		t.Errorf("GET /api/session returned CSRF token %q, want %q", again.CSRFToken, sess.CSRFToken)
+	}
+	if w := do("DELETE", "/api/session", nil, "Cookie", withCookie, "X-CSRF-Token", sess.CSRFToken); w.Code != http.StatusNoContent {
+		t.Errorf("logout: %d", w.Code)
+	}
+	if w := do("GET", "/api/status", nil, "Cookie", withCookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET after logout: %d, want 401", w.Code)
+	}
+}
+
+func TestRequestIDsInLogs(t *testing.T) {
+	var logs bytes.Buffer
+	s := newTestServer(t, Config{
+		Client: spotify.NewClient(),
+		Logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+	})
+	do := requester(s.Handler(), withToken...)
+
+	w := do("GET", "/api/status", nil, "X-Request-ID", "abc-123")
+	if got := w.Header().Get("X-Request-ID"); got != "abc-123" {
+		t.Errorf("X-Request-ID = %q, want the one sent", got)
+	}
+
+	w = do("GET", "/api/status", nil, "X-Request-ID", "not valid\n")
+	generated := w.Header().Get("X-Request-ID")
+	if generated == "" || generated == "not valid\n" {
+		t.Errorf("X-Request-ID = %q, want a generated one", generated)
+	}
+
+	var ids []string
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var line struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Msg == "request" {
+			ids = append(ids, line.RequestID)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "abc-123" || ids[1] != generated {
+		t.Errorf("logged request IDs = %q, want [abc-123 %s]", ids, generated)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := newTestServer(t, Config{Client: spotify.NewClient()})
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d", w.Code)
+	}
+	for _, name := range []string{"spotify_backup_last_success_timestamp_seconds", "spotify_backup_bytes_written_total", "spotify_backup_token_refresh_failures_total"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("/metrics does not expose %s", name)
+		}
+	}
+}
+
+func TestScheduleAndManualBackup(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	tokenFile := filepath.Join(t.TempDir(), ".token")
+	if err := auth.SaveRefreshToken(tokenFile, fake.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	s := newTestServer(t, Config{
+		Client:       fake.SpotifyClient(),
+		ClientID:     fake.ClientID,
+		ClientSecret: fake.ClientSecret,
+		TokenFile:    tokenFile,
+		Backup:       backup.Options{OutDir: out},
+	})
+	do := requester(s.Handler(), withToken...)
+
+	if w := do("PUT", "/api/schedule", scheduler.Config{Enabled: true, Cron: "every day"}); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid cron: %d %s", w.Code, w.Body)
+	}
+	w := do("PUT", "/api/schedule", scheduler.Config{Enabled: true, Cron: "0 3 * * *"})
+	var st scheduler.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("set schedule: %d %s", w.Code, w.Body)
+	}
+	if st.NextRun == nil || st.NextRun.Hour() != 3 {
+		t.Errorf("next run = %v, want 03:00", st.NextRun)
+	}
+
+	if w := do("POST", "/api/backup", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("start backup: %d %s", w.Code, w.Body)
+	}
+	s.users[defaultUser].sched.Wait()
+	json.Unmarshal(do("GET", "/api/schedule", nil).Body.Bytes(), &st)
+	if st.LastRun == nil || st.LastOutcome != backup.OutcomeSuccess || st.Running {
+		t.Errorf("status after backup = %+v", st)
+	}
+	if index, err := storage.ReadIndex(out); err != nil || len(index) != 3 {
+		t.Errorf("index = %v, %v; want the 3 playlists", index, err)
+	}
+}
+
+func TestUsersAreIsolated(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	usersDir := t.TempDir()
+	adminOut := t.TempDir()
+	s := newTestServer(t, Config{
+		Client:       fake.SpotifyClient(),
+		ClientID:     fake.ClientID,
+		ClientSecret: fake.ClientSecret,
+		RedirectURI:  "http://localhost:8080/api/auth/callback",
+		Backup:       backup.Options{OutDir: adminOut},
+		Users: map[string]string{
+			"alice": "alice-pw",
+			// bcrypt hash of "bob-pw"
+			"bob": "$2a$05$ylIuqFJiShRxyjapdNVEjekfDRW7WTytiULScnek3iPqyPI41J9h2",
+		},
+		UsersDir: usersDir,
+	})
+	do := requester(s.Handler())
+	// login returns the headers of requests in the user's session
+	login := func(name, password string) []string {
+		t.Helper()
+		w := do("POST", "/api/session", LoginRequest{Username: name, Password: password})
+		var sess SessionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil || w.Code != http.StatusOK || sess.User != name {
+			t.Fatalf("login as %s: %d %s", name, w.Code, w.Body)
+		}
+		cookie := w.Result().Cookies()[0]
+		return []string{"Cookie", cookie.Name + "=" + cookie.Value, "X-CSRF-Token", sess.CSRFToken}
+	}
+	alice := login("alice", "alice-pw")
+	bob := login("bob", "bob-pw")
+	if w := do("POST", "/api/session", LoginRequest{Username: "alice", Password: "bob-pw"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with another user's password: %d, want 401", w.Code)
+	}
+
+	// alice links her Spotify account
+	var setup AuthSetupResponse
+	json.Unmarshal(do("POST", "/api/auth/start", nil, alice...).Body.Bytes(), &setup)
+	callback, err := authorize(setup.AuthURL)
+	if err != nil || callback.Query().Get("state") == "" {
+		t.Fatalf("authorize redirect = %v, %v; want a state", callback, err)
+	}
+	if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: %d, want 400", w.Code)
+	}
+	if rt, err := auth.LoadRefreshToken(filepath.Join(usersDir, "alice", ".token")); err != nil || rt != fake.RefreshToken {
+		t.Errorf("alice's refresh token = %q, %v", rt, err)
+	}
+
+	var status StatusResponse
+	json.Unmarshal(do("GET", "/api/status", nil, alice...).Body.Bytes(), &status)
+	if !status.HasToken {
+		t.Errorf("alice's status = %+v, want hasToken", status)
+	}
+	json.Unmarshal(do("GET", "/api/status", nil, bob...).Body.Bytes(), &status)
+	if status.HasToken {
+		t.Errorf("bob's status = %+v, want no token", status)
+	}
+	if w := do("POST", "/api/backup", nil, bob...); w.Code != http.StatusBadRequest {
+		t.Errorf("bob's backup without a Spotify account: %d, want 400", w.Code)
+	}
+
+	if w := do("PUT", "/api/schedule", scheduler.Config{Enabled: true, Interval: "12h"}, alice...); w.Code != http.StatusOK {
+		t.Fatalf("alice's schedule: %d %s", w.Code, w.Body)
+	}
+	var st scheduler.Status
+	json.Unmarshal(do("GET", "/api/schedule", nil, bob...).Body.Bytes(), &st)
+	if st.Enabled {
+		t.Errorf("bob's schedule = %+v, want alice's not to show", st)
+	}
+
+	if w := do("POST", "/api/backup", nil, alice...); w.Code != http.StatusAccepted {
+		t.Fatalf("alice's backup: %d %s", w.Code, w.Body)
+	}
+	s.users["alice"].sched.Wait()
+	if index, err := storage.ReadIndex(filepath.Join(usersDir, "alice", "out")); err != nil || len(index) != 3 {
+		t.Errorf("alice's index = %v, %v; want the 3 playlists", index, err)
+	}
+	if _, err := storage.ReadIndex(adminOut); err == nil {
+		t.Error("alice's backup was written to the admin's directory")
+	}
+}
+
+func TestMeAndLogout(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, ".token")
+	if err := auth.SaveRefreshToken(tokenFile, fake.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		Client:       fake.SpotifyClient(),
+		ClientID:     fake.ClientID,
+		ClientSecret: fake.ClientSecret,
+		RedirectURI:  "http://localhost:8080/api/auth/callback",
+		TokenFile:    tokenFile,
+		SettingsFile: filepath.Join(dir, SettingsFile),
+	})
+	do := requester(s.Handler(), withToken...)
+	me := func() MeResponse {
+		t.Helper()
+		w := do("GET", "/api/auth/me", nil)
+		var me MeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET /api/auth/me: %d %s", w.Code, w.Body)
+		}
+		return me
+	}
+
+	// the scopes of a token loaded from disk are learned when refreshing it
+	if got := me(); got.ID != "alice" || got.DisplayName != "Alice" || strings.Join(got.Scopes, " ") != fake.Scope {
+		t.Errorf("me = %+v, want Alice with scopes %q", got, fake.Scope)
+	}
+
+	var start AuthSetupResponse
+	json.Unmarshal(do("POST", "/api/auth/start", nil).Body.Bytes(), &start)
+	callback, err := authorize(start.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	if got := me(); strings.Join(got.Scopes, " ") != fake.Scope {
+		t.Errorf("scopes = %q, want %q", got.Scopes, fake.Scope)
+	}
+
+	if w := do("POST", "/api/auth/logout", LogoutRequest{ResetCredentials: true}); w.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Errorf("token file after logout: %v, want it deleted", err)
+	}
+	var status StatusResponse
+	json.Unmarshal(do("GET", "/api/status", nil).Body.Bytes(), &status)
+	if status.HasToken || !status.NeedsSetup {
+		t.Errorf("status after logout = %+v, want no token and no credentials", status)
+	}
+	if w := do("GET", "/api/auth/me", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /api/auth/me after logout: %d, want 400", w.Code)
+	}
+	if settings, err := LoadSettings(filepath.Join(dir, SettingsFile)); err != nil || settings.ClientID != "" {
+		t.Errorf("saved settings = %+v, %v; want the credentials removed", settings, err)
+	}
+	// logging out twice is harmless
+	if w := do("POST", "/api/auth/logout", nil); w.Code != http.StatusOK {
+		t.Errorf("second logout: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStatusChecksTokenAndScopes(t *testing.T) {
+	status := func(t *testing.T, fake *spotifytest.Server, refreshToken string) StatusResponse {
+		t.Helper()
+		tokenFile := filepath.Join(t.TempDir(), ".token")
+		if err := auth.SaveRefreshToken(tokenFile, refreshToken); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestServer(t, Config{
+			Client:       fake.SpotifyClient(),
+			ClientID:     fake.ClientID,
+			ClientSecret: fake.ClientSecret,
+			TokenFile:    tokenFile,
+		})
+		w := requester(s.Handler(), withToken...)("GET", "/api/status", nil)
+		var st StatusResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		fake := newFakeSpotify(t)
+		st := status(t, fake, fake.RefreshToken)
+		if !st.TokenValid || st.NeedsReauth || len(st.MissingScopes) != 0 || strings.Join(st.Scopes, " ") != fake.Scope {
+			t.Errorf("status = %+v, want a valid token with every scope", st)
+		}
+		if got := fake.Requests(); !slices.Contains(got, "GET /v1/me") {
+			t.Errorf("requests = %q, want the token checked against /v1/me", got)
+		}
+	})
+
+	t.Run("missing scopes", func(t *testing.T) {
+		fake := newFakeSpotify(t)
+		fake.Scope = "playlist-read-private"
+		st := status(t, fake, fake.RefreshToken)
+		want := map[string][]string{
+			"collaborativePlaylists": {"playlist-read-collaborative"},
+			"library":                {"user-library-read"},
+		}
+		if !st.TokenValid || !st.NeedsReauth || !reflect.DeepEqual(st.MissingScopes, want) {
+			t.Errorf("status = %+v, want missing scopes %v", st, want)
+		}
+	})
+
+	t.Run("unknown scopes", func(t *testing.T) {
+		fake := newFakeSpotify(t)
+		// a token response without scope says nothing about what is missing
+		fake.Scope = ""
+		st := status(t, fake, fake.RefreshToken)
+		if !st.TokenValid || st.NeedsReauth || st.Scopes != nil || st.MissingScopes != nil {
+			t.Errorf("status = %+v, want a valid token with unknown scopes", st)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		fake := newFakeSpotify(t)
+		st := status(t, fake, "revoked-refresh-token")
+		if !st.HasToken || st.TokenValid || !st.NeedsReauth {
+			t.Errorf("status = %+v, want a rejected token needing reauthorization", st)
+		}
+	})
+}
+
+func TestSettingsOverrideCredentials(t *testing.T) {
+	saved := Settings{ClientID: "saved-id", ClientSecret: "saved-secret", RedirectURI: "http://127.0.0.1:8080/api/auth/callback"}
+
+	// only the ID set in the environment keeps the saved secret
+	got := saved.Override(Overrides{ClientID: "env-id"})
+	if got.ClientID != "env-id" || got.ClientSecret != "saved-secret" || got.RedirectURI != saved.RedirectURI {
+		t.Errorf("override of the ID = %+v", got)
+	}
+	got = saved.Override(Overrides{ClientSecret: "env-secret"})
+	if got.ClientID != "saved-id" || got.ClientSecret != "env-secret" {
+		t.Errorf("override of the secret = %+v", got)
+	}
+	if got.Backup == nil {
+		t.Error("override leaves no backup settings")
+	}
+}
+
+func TestCredentialsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Client:       spotify.NewClient(),
+		RedirectURI:  "http://localhost:8080/api/auth/callback",
+		TokenFile:    filepath.Join(dir, ".token"),
+		ScheduleFile: filepath.Join(dir, "schedule.json"),
+		SettingsFile: filepath.Join(dir, SettingsFile),
+		APIToken:     testToken,
+		Users:        map[string]string{"alice": "alice-pw"},
+		UsersDir:     filepath.Join(dir, "users"),
+	}
+	// header is withToken for the admin, or the headers of alice's session
+	status := func(s *Server, header []string) StatusResponse {
+		t.Helper()
+		w := requester(s.Handler(), header...)("GET", "/api/status", nil)
+		var st StatusResponse
+		json.Unmarshal(w.Body.Bytes(), &st)
+		return st
+	}
+	setup := func(s *Server, header []string, clientID string) {
+		t.Helper()
+		w := requester(s.Handler(), header...)("POST", "/api/auth/setup", AuthSetupRequest{ClientID: clientID, ClientSecret: "secret"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("setup: %d %s", w.Code, w.Body)
+		}
+	}
+	login := func(s *Server) []string {
+		t.Helper()
+		w := requester(s.Handler())("POST", "/api/session", LoginRequest{Username: "alice", Password: "alice-pw"})
+		var sess SessionResponse
+		json.Unmarshal(w.Body.Bytes(), &sess)
+		cookie := w.Result().Cookies()[0]
+		return []string{"Cookie", cookie.Name + "=" + cookie.Value, "X-CSRF-Token", sess.CSRFToken}
+	}
+
+	s := newTestServer(t, cfg)
+	setup(s, withToken, "admin-app")
+	setup(s, login(s), "alice-app")
+
+	for _, file := range []string{cfg.SettingsFile, filepath.Join(cfg.UsersDir, "alice", SettingsFile)} {
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("%s: %v, %v; want it readable by the owner only", file, info, err)
+		}
+	}
+
+	restarted := newTestServer(t, cfg)
+	if st := status(restarted, withToken); !st.HasClientID || st.NeedsSetup {
+		t.Errorf("admin status after restart = %+v, want the saved credentials", st)
+	}
+	if st := status(restarted, login(restarted)); !st.HasClientID {
+		t.Errorf("alice's status after restart = %+v, want the saved credentials", st)
+	}
+	if id := restarted.users["alice"].state.Credentials().ClientID; id != "alice-app" {
+		t.Errorf("alice's client ID = %q, want alice-app", id)
+	}
+	if id := restarted.users[defaultUser].state.Credentials().ClientID; id != "admin-app" {
+		t.Errorf("admin's client ID = %q, want admin-app", id)
+	}
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	fake := newFakeSpotify(t)
+
+	s := newTestServer(t, Config{
+		Client:      fake.SpotifyClient(),
+		RedirectURI: "http://localhost:8080/api/auth/callback",
+		Backup:      backup.Options{OutDir: t.TempDir()},
+	})
+	do := requester(s.Handler(), withToken...)
+
+	// every worker runs the whole web flow while the others do the same
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				do("GET", "/api/status", nil)
+				w := do("POST", "/api/auth/setup", AuthSetupRequest{ClientID: fake.ClientID, ClientSecret: fake.ClientSecret})
+				var setup AuthSetupResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &setup); err != nil || !setup.Success {
+					t.Errorf("setup: %d %s", w.Code, w.Body)
+					return
+				}
+				do("POST", "/api/auth/start", nil)
+				callback, err := authorize(setup.AuthURL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if w := do("GET", callback.RequestURI(), nil); w.Code != http.StatusOK {
+					t.Errorf("callback: %d %s", w.Code, w.Body)
+				}
+				do("PUT", "/api/schedule", scheduler.Config{Enabled: j%2 == 0, Interval: "1h"})
+				do("GET", "/api/schedule", nil)
+				if w := do("POST", "/api/backup", nil); w.Code != http.StatusAccepted && w.Code != http.StatusConflict {
+					t.Errorf("start backup: %d %s", w.Code, w.Body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.users[defaultUser].sched.Wait()
+
+	var status StatusResponse
+	json.Unmarshal(do("GET", "/api/status", nil).Body.Bytes(), &status)
+	if !status.HasToken || !status.HasClientID {
+		t.Errorf("status = %+v, want client credentials and a token", status)
+	}
+}
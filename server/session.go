@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie = "spotify_backup_session"
+	csrfHeader    = "X-CSRF-Token"
+	sessionTTL    = 24 * time.Hour
+)
+
+// session is a browser logged in as a user.
+type session struct {
+	user    string
+	csrf    string // sent back in csrfHeader on every state-changing request
+	expires time.Time
+}
+
+// sessionStore keeps the sessions in memory; a restart logs everyone out.
+type sessionStore struct {
+	mu sync.Mutex
+	m  map[string]session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{m: make(map[string]session)}
+}
+
+// create starts a session for user and returns its ID and CSRF token.
+func (st *sessionStore) create(user string) (id, csrf string) {
+	id, csrf = randomToken(), randomToken()
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k, sess := range st.m {
+		if now.After(sess.expires) {
+			delete(st.m, k)
+		}
+	}
+	st.m[id] = session{user: user, csrf: csrf, expires: now.Add(sessionTTL)}
+	return id, csrf
+}
+
+// get returns the live session with the given ID.
+func (st *sessionStore) get(id string) (session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.m[id]
+	if !ok || time.Now().After(sess.expires) {
+		delete(st.m, id)
+		return session{}, false
+	}
+	return sess, true
+}
+
+func (st *sessionStore) delete(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.m, id)
+}
+
+// randomToken returns 32 random bytes, hex encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// equal compares secrets in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type LoginRequest struct {
+	Username string `json:"username"` // empty means the admin user
+	Password string `json:"password" binding:"required"`
+}
+
+type SessionResponse struct {
+	User      string `json:"user"`
+	CSRFToken string `json:"csrfToken"`
+}
+
+// handleLogin checks the password of a user and starts a session.
+func (s *Server) handleLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Username == "" {
+		req.Username = defaultUser
+	}
+	u, ok := s.users[req.Username]
+	if !ok || !u.checkPassword(req.Password) {
+		s.log(c).Warn("failed login", "user", req.Username, "client_ip", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "wrong user name or password"})
+		return
+	}
+	id, csrf := s.sessions.create(u.name)
+	s.setSessionCookie(c, id, int(sessionTTL/time.Second))
+	c.JSON(http.StatusOK, SessionResponse{User: u.name, CSRFToken: csrf})
+}
+
+// handleGetSession returns the CSRF token of the current session, so the UI
+// can pick it up again after a reload.
+func (s *Server) handleGetSession(c *gin.Context) {
+	id, _ := c.Cookie(sessionCookie)
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "not logged in"})
+		return
+	}
+	c.JSON(http.StatusOK, SessionResponse{User: sess.user, CSRFToken: sess.csrf})
+}
+
+// handleLogout ends the current session.
+func (s *Server) handleLogout(c *gin.Context) {
+	if id, err := c.Cookie(sessionCookie); err == nil {
+		s.sessions.delete(id)
+	}
+	s.setSessionCookie(c, "", -1)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) setSessionCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, value, maxAge, "/", "", isHTTPS(c), true)
+}
+
+// isHTTPS tells if the browser reached the server over HTTPS, directly or
+// through a reverse proxy.
+func isHTTPS(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// requireAuth lets a request through if it carries the API token, acting
+// as the admin user, or a session cookie. Requests authenticated by cookie
+// must also send the session's CSRF token unless they are read-only.
+func (s *Server) requireAuth(c *gin.Context) {
+	if h := c.GetHeader("Authorization"); h != "" {
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok || s.apiToken == "" || !equal(token, s.apiToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid API token"})
+			return
+		}
+		s.setUser(c, s.users[defaultUser])
+		c.Next()
+		return
+	}
+
+	id, _ := c.Cookie(sessionCookie)
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "not logged in"})
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !equal(c.GetHeader(csrfHeader), sess.csrf) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: "missing or invalid CSRF token"})
+			return
+		}
+	}
+	s.setUser(c, s.users[sess.user])
+	c.Next()
+}
+
+// setUser records who is making the request and tags its logs with them.
+func (s *Server) setUser(c *gin.Context, u *user) {
+	c.Set(userKey, u)
+	c.Set(loggerKey, s.log(c).With("user", u.name))
+}
+
+// user returns the user making a request that passed requireAuth.
+func (s *Server) user(c *gin.Context) *user {
+	return c.MustGet(userKey).(*user)
+}
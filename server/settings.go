@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"spotify-backup/backup"
+	"spotify-backup/storage"
+)
+
+// SettingsFile is the name of the file a user's Settings are kept in.
+const SettingsFile = "config.json"
+
+// Settings are the configuration of web mode kept in the data volume, so
+// client credentials entered in the UI survive a restart.
+type Settings struct {
+	ClientID     string           `json:"client_id,omitempty"`
+	ClientSecret string           `json:"client_secret,omitempty"`
+	RedirectURI  string           `json:"redirect_uri,omitempty"`
+	Backup       *backup.Settings `json:"backup,omitempty"`
+}
+
+// Overrides replace some of the saved Settings, e.g. with those set in the
+// environment. The client credentials and redirect URI only override when
+// not empty, so they can still be entered in the UI.
+type Overrides struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Backup       backup.Overrides
+}
+
+// Override returns s with the fields set in o replacing its own. The
+// backup settings are always set afterwards.
+func (s Settings) Override(o Overrides) Settings {
+	if o.ClientID != "" {
+		s.ClientID = o.ClientID
+	}
+	if o.ClientSecret != "" {
+		s.ClientSecret = o.ClientSecret
+	}
+	if o.RedirectURI != "" {
+		s.RedirectURI = o.RedirectURI
+	}
+	var b backup.Settings
+	if s.Backup != nil {
+		b = *s.Backup
+	}
+	b = b.Override(o.Backup)
+	s.Backup = &b
+	return s
+}
+
+// LoadSettings reads settings saved by SaveSettings. A missing file means
+// no settings.
+func LoadSettings(file string) (Settings, error) {
+	var s Settings
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("decode %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// SaveSettings writes the settings, readable only by the owner since they
+// hold the client secret.
+func SaveSettings(file string, s Settings) error {
+	return storage.WriteJSONFilePerm(file, s, 0o600)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials identify the Spotify app a user authorizes.
+type Credentials struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+}
+
+// AppState is the Spotify authorization state of a user. Handlers and
+// backups use it concurrently, so it is only accessed through its methods.
+type AppState struct {
+	mu           sync.RWMutex
+	cred         Credentials
+	accessToken  string
+	refreshToken string
+	scope        string    // granted with the tokens; empty if unknown
+	verified     time.Time // when Spotify last accepted the tokens
+}
+
+// NewAppState returns a state with the given app and no tokens.
+func NewAppState(cred Credentials) *AppState {
+	return &AppState{cred: cred}
+}
+
+// Credentials returns the app the user authorizes.
+func (st *AppState) Credentials() Credentials {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.cred
+}
+
+// SetClient replaces the client ID and secret, keeping the redirect URI.
+func (st *AppState) SetClient(id, secret string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.cred.ClientID, st.cred.ClientSecret = id, secret
+}
+
+// Tokens returns the access and refresh tokens; either may be empty.
+func (st *AppState) Tokens() (access, refresh string) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.accessToken, st.refreshToken
+}
+
+// SetTokens stores the tokens of a new grant and the scopes it granted.
+func (st *AppState) SetTokens(access, refresh, scope string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.accessToken, st.refreshToken, st.scope = access, refresh, scope
+	st.verified = time.Time{}
+}
+
+// Scopes returns the scopes granted with the tokens, or nil if unknown.
+func (st *AppState) Scopes() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.scope == "" {
+		return nil
+	}
+	return strings.Fields(st.scope)
+}
+
+// Logout forgets the tokens and, if resetClient is set, the client ID and
+// secret.
+func (st *AppState) Logout(resetClient bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.accessToken, st.refreshToken, st.scope = "", "", ""
+	st.verified = time.Time{}
+	if resetClient {
+		st.cred.ClientID, st.cred.ClientSecret = "", ""
+	}
+}
+
+// SetAccessToken stores a refreshed access token, keeping the refresh token.
+// An empty scope keeps the scopes known so far.
+func (st *AppState) SetAccessToken(access, scope string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.accessToken = access
+	if scope != "" {
+		st.scope = scope
+	}
+}
+
+// MarkVerified records that Spotify accepted the tokens just now.
+func (st *AppState) MarkVerified() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.verified = time.Now()
+}
+
+// VerifiedWithin reports whether Spotify accepted the tokens within d.
+func (st *AppState) VerifiedWithin(d time.Duration) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return !st.verified.IsZero() && time.Since(st.verified) < d
+}
+
+// HasToken reports whether the user authorized the app.
+func (st *AppState) HasToken() bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.accessToken != "" || st.refreshToken != ""
+}
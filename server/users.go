@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"spotify-backup/auth"
+	"spotify-backup/backup"
+	"spotify-backup/scheduler"
+)
+
+// defaultUser is the account of the admin password and the API token. It
+// keeps its token, schedule and backups where a single-user setup had them.
+const defaultUser = "admin"
+
+const userKey = "user"
+
+// validUserName keeps user names usable as directory names.
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
+// user is a web user with their own Spotify authorization, schedule and
+// backup directory.
+type user struct {
+	name         string
+	password     string // plain text or a bcrypt hash; empty disables logging in
+	state        *AppState
+	tokenFile    string
+	settingsFile string // may be empty, then nothing is saved
+	backup       backup.Options
+	sched        *scheduler.Scheduler
+
+	saveMu sync.Mutex // serializes updates of settingsFile
+}
+
+// checkPassword compares a password with the user's, which may be a bcrypt
+// hash as written by htpasswd -B.
+func (u *user) checkPassword(password string) bool {
+	switch {
+	case u.password == "":
+		return false
+	case strings.HasPrefix(u.password, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(u.password), []byte(password)) == nil
+	}
+	return equal(password, u.password)
+}
+
+// ReadUsersFile reads web users from lines of "name:password", where the
+// password may be a bcrypt hash. Blank lines and lines starting with # are
+// skipped.
+func ReadUsersFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, password, ok := strings.Cut(line, ":")
+		if !ok || password == "" {
+			return nil, fmt.Errorf("%s:%d: want name:password", file, n)
+		}
+		if _, dup := users[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", file, n, name)
+		}
+		users[name] = password
+	}
+	return users, sc.Err()
+}
+
+// addUser sets up a user, picking up the settings, refresh token and
+// schedule saved by an earlier run.
+func (s *Server) addUser(u *user, scheduleFile string) error {
+	cred := s.defaults.credentials
+	if u.settingsFile != "" {
+		saved, err := LoadSettings(u.settingsFile)
+		if err != nil {
+			return fmt.Errorf("load settings of %s: %w", u.name, err)
+		}
+		if saved.ClientID != "" {
+			cred.ClientID, cred.ClientSecret = saved.ClientID, saved.ClientSecret
+		}
+		if saved.RedirectURI != "" {
+			cred.RedirectURI = saved.RedirectURI
+		}
+		if saved.Backup != nil && u.name != defaultUser {
+			// the admin's are set by the caller, from the same file
+			opts, err := saved.Backup.Options()
+			if err != nil {
+				return fmt.Errorf("settings of %s: %w", u.name, err)
+			}
+			opts.OutDir = u.backup.OutDir
+			opts.ToolVersion = u.backup.ToolVersion
+			u.backup = opts
+		}
+	}
+	u.state = NewAppState(cred)
+	if rt, err := auth.LoadRefreshToken(u.tokenFile); err == nil && rt != "" {
+		u.state.SetTokens("", rt, "")
+		s.logger.Info("loaded refresh token", "user", u.name, "file", u.tokenFile)
+	}
+
+	run := func(ctx context.Context, trigger string) string { return s.runBackup(ctx, u, trigger) }
+	sched, err := scheduler.New(scheduleFile, run, s.logger.With("user", u.name))
+	if err != nil {
+		return fmt.Errorf("load schedule of %s: %w", u.name, err)
+	}
+	u.sched = sched
+	s.users[u.name] = u
+	return nil
+}
+
+// newUser returns a user keeping their files in their own directory under
+// dir, and the path of their schedule file.
+func (s *Server) newUser(name, password, dir string) (*user, string, error) {
+	if !validUserName.MatchString(name) {
+		return nil, "", fmt.Errorf("invalid user name %q", name)
+	}
+	home := filepath.Join(dir, name)
+	if err := os.MkdirAll(home, 0o700); err != nil {
+		return nil, "", err
+	}
+	u := &user{
+		name:         name,
+		password:     password,
+		tokenFile:    filepath.Join(home, ".token"),
+		settingsFile: filepath.Join(home, SettingsFile),
+		backup:       s.defaults.backup,
+	}
+	u.backup.OutDir = filepath.Join(home, "out")
+	return u, filepath.Join(home, "schedule.json"), nil
+}
+
+// saveCredentials saves the client credentials of u in their settings,
+// keeping the other settings.
+func (s *Server) saveCredentials(u *user) error {
+	if u.settingsFile == "" {
+		return nil
+	}
+	u.saveMu.Lock()
+	defer u.saveMu.Unlock()
+	settings, err := LoadSettings(u.settingsFile)
+	if err != nil {
+		return err
+	}
+	cred := u.state.Credentials()
+	settings.ClientID, settings.ClientSecret = cred.ClientID, cred.ClientSecret
+	return SaveSettings(u.settingsFile, settings)
+}
+
+// authStateTTL is how long a user has to grant access on Spotify.
+const authStateTTL = 15 * time.Minute
+
+// authStates remembers which user started an authorization and with which
+// redirect URI, by the state parameter passed through Spotify to the
+// callback.
+type authStates struct {
+	mu sync.Mutex
+	m  map[string]pendingAuth
+}
+
+type pendingAuth struct {
+	user        string
+	redirectURI string // must be sent again when exchanging the code
+	expires     time.Time
+}
+
+func newAuthStates() *authStates {
+	return &authStates{m: make(map[string]pendingAuth)}
+}
+
+// begin returns a state for an authorization started by user.
+func (a *authStates) begin(user, redirectURI string) string {
+	state := randomToken()
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, p := range a.m {
+		if now.After(p.expires) {
+			delete(a.m, k)
+		}
+	}
+	a.m[state] = pendingAuth{user: user, redirectURI: redirectURI, expires: now.Add(authStateTTL)}
+	return state
+}
+
+// finish returns the authorization started with state; a state is only
+// good for one callback.
+func (a *authStates) finish(state string) (pendingAuth, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.m[state]
+	delete(a.m, state)
+	if !ok || time.Now().After(p.expires) {
+		return pendingAuth{}, false
+	}
+	return p, true
+}
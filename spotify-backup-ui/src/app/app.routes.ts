@@ -1,10 +1,13 @@
 import { Routes } from '@angular/router';
 import { Home } from './pages/home/home';
 import { Config } from './pages/config/config';
+import { Login } from './pages/login/login';
+import { authGuard } from './services/auth.guard';
 
 export const routes: Routes = [
   { path: '', redirectTo: '/home', pathMatch: 'full' },
-  { path: 'home', component: Home },
-  { path: 'config', component: Config },
+  { path: 'login', component: Login },
+  { path: 'home', component: Home, canActivate: [authGuard] },
+  { path: 'config', component: Config, canActivate: [authGuard] },
   { path: '**', redirectTo: '/home' }
 ];
@@ -25,6 +25,11 @@ export class Home implements OnInit {
 
   constructor(private backend: Backend) {}
 
+  /** Features that can't be backed up with the scopes granted so far */
+  missingFeatures(): string[] {
+    return Object.keys(this.status()?.missingScopes ?? {});
+  }
+
   ngOnInit() {
     this.checkStatus();
   }
@@ -0,0 +1,50 @@
+import { Component, signal } from '@angular/core';
+import { CommonModule } from '@angular/common';
+import { FormsModule } from '@angular/forms';
+import { Router } from '@angular/router';
+import { MatCardModule } from '@angular/material/card';
+import { MatFormFieldModule } from '@angular/material/form-field';
+import { MatInputModule } from '@angular/material/input';
+import { MatButtonModule } from '@angular/material/button';
+import { MatIconModule } from '@angular/material/icon';
+import { Backend } from '../../services/backend';
+
+@Component({
+  selector: 'app-login',
+  standalone: true,
+  imports: [
+    CommonModule,
+    FormsModule,
+    MatCardModule,
+    MatFormFieldModule,
+    MatInputModule,
+    MatButtonModule,
+    MatIconModule
+  ],
+  templateUrl: './login.html',
+  styleUrls: ['./login.css']
+})
+export class Login {
+  username = signal('');
+  password = signal('');
+  loggingIn = signal(false);
+  error = signal<string | null>(null);
+
+  constructor(private backend: Backend, private router: Router) {}
+
+  login() {
+    this.loggingIn.set(true);
+    this.error.set(null);
+
+    this.backend.login(this.username(), this.password()).subscribe({
+      next: () => {
+        this.loggingIn.set(false);
+        this.router.navigate(['/home']);
+      },
+      error: (err) => {
+        this.loggingIn.set(false);
+        this.error.set(err.status === 401 ? 'Wrong user name or password' : 'Failed to connect to backend');
+      }
+    });
+  }
+}
@@ -0,0 +1,20 @@
+import { inject } from '@angular/core';
+import { CanActivateFn, Router } from '@angular/router';
+import { catchError, map, of } from 'rxjs';
+import { Backend } from './backend';
+
+/**
+ * Lets the user through if they are logged in, picking up the session of an
+ * earlier login after a reload.
+ */
+export const authGuard: CanActivateFn = () => {
+  const backend = inject(Backend);
+  const router = inject(Router);
+  if (backend.csrfToken) {
+    return true;
+  }
+  return backend.getSession().pipe(
+    map(() => true),
+    catchError(() => of(router.createUrlTree(['/login'])))
+  );
+};
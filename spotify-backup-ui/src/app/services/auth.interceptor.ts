@@ -0,0 +1,31 @@
+import { HttpErrorResponse, HttpInterceptorFn } from '@angular/common/http';
+import { inject } from '@angular/core';
+import { Router } from '@angular/router';
+import { catchError, throwError } from 'rxjs';
+import { Backend } from './backend';
+
+const readOnly = ['GET', 'HEAD', 'OPTIONS'];
+
+/**
+ * Sends the session cookie and CSRF token with API requests and goes to the
+ * login page when the session has expired.
+ */
+export const authInterceptor: HttpInterceptorFn = (req, next) => {
+  const backend = inject(Backend);
+  const router = inject(Router);
+
+  let headers = req.headers;
+  if (!readOnly.includes(req.method) && backend.csrfToken) {
+    headers = headers.set('X-CSRF-Token', backend.csrfToken);
+  }
+
+  return next(req.clone({ headers, withCredentials: true })).pipe(
+    catchError((err: HttpErrorResponse) => {
+      if (err.status === 401 && !req.url.endsWith('/session')) {
+        backend.csrfToken = null;
+        router.navigate(['/login']);
+      }
+      return throwError(() => err);
+    })
+  );
+};
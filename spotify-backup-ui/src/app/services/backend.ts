@@ -1,11 +1,15 @@
 import { Injectable } from '@angular/core';
 import { HttpClient } from '@angular/common/http';
-import { Observable } from 'rxjs';
+import { Observable, tap } from 'rxjs';
 
 export interface StatusResponse {
   hasToken: boolean;
   hasClientId: boolean;
   needsSetup: boolean;
+  tokenValid: boolean;
+  needsReauth: boolean;
+  scopes?: string[];
+  missingScopes?: Record<string, string[]>;
   message: string;
 }
 
@@ -18,6 +22,18 @@ export interface AuthSetupResponse {
   success: boolean;
   message: string;
   authUrl?: string;
+  redirectUri?: string;
+}
+
+export interface SessionResponse {
+  user: string;
+  csrfToken: string;
+}
+
+export interface MeResponse {
+  id: string;
+  displayName: string;
+  scopes: string[];
 }
 
 export interface ErrorResponse {
@@ -30,8 +46,35 @@ export interface ErrorResponse {
 export class Backend {
   private readonly apiUrl = '/api';
 
+  /** CSRF token of the current session, sent with every state-changing request */
+  csrfToken: string | null = null;
+
   constructor(private http: HttpClient) {}
 
+  /**
+   * Log in; the server sets a session cookie. An empty username means admin
+   */
+  login(username: string, password: string): Observable<SessionResponse> {
+    return this.http
+      .post<SessionResponse>(`${this.apiUrl}/session`, { username, password })
+      .pipe(tap((session) => (this.csrfToken = session.csrfToken)));
+  }
+
+  /**
+   * Resume the session of an earlier login, e.g. after a page reload
+   */
+  getSession(): Observable<SessionResponse> {
+    return this.http
+      .get<SessionResponse>(`${this.apiUrl}/session`)
+      .pipe(tap((session) => (this.csrfToken = session.csrfToken)));
+  }
+
+  logout(): Observable<void> {
+    return this.http
+      .delete<void>(`${this.apiUrl}/session`)
+      .pipe(tap(() => (this.csrfToken = null)));
+  }
+
   /**
    * Check the status of authentication (token availability and client credentials)
    */
@@ -54,10 +97,24 @@ export class Backend {
   /**
    * Start the OAuth flow (alternative to setupAuth if credentials already configured)
    */
-  startAuth(): Observable<{ authUrl: string; message: string }> {
-    return this.http.post<{ authUrl: string; message: string }>(
+  startAuth(): Observable<{ authUrl: string; redirectUri: string; message: string }> {
+    return this.http.post<{ authUrl: string; redirectUri: string; message: string }>(
       `${this.apiUrl}/auth/start`,
       {}
     );
   }
+
+  /**
+   * Get the profile of the linked Spotify account and the granted scopes
+   */
+  getMe(): Observable<MeResponse> {
+    return this.http.get<MeResponse>(`${this.apiUrl}/auth/me`);
+  }
+
+  /**
+   * Disconnect the Spotify account, optionally forgetting the client credentials too
+   */
+  disconnectSpotify(resetCredentials = false): Observable<AuthSetupResponse> {
+    return this.http.post<AuthSetupResponse>(`${this.apiUrl}/auth/logout`, { resetCredentials });
+  }
 }
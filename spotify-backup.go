@@ -2,136 +2,187 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"mime"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
-	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"runtime"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"spotify-backup/accountdata"
+	"spotify-backup/auth"
+	"spotify-backup/backup"
+	"spotify-backup/metrics"
+	"spotify-backup/notify"
+	"spotify-backup/server"
+	"spotify-backup/spotify"
+	"spotify-backup/storage"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// exitPartial is the exit status of a backup that finished but skipped some
+// playlists, images or tracks. Fatal errors and interrupted runs exit with 1.
+const exitPartial = 2
+
 var (
 	envAccessToken     = "SPOTIFY_ACCESS_TOKEN"  // optional: direct token
 	envRefreshToken    = "SPOTIFY_REFRESH_TOKEN" // optional: use with client id/secret
 	envClientID        = "SPOTIFY_CLIENT_ID"
 	envClientSecret    = "SPOTIFY_CLIENT_SECRET"
 	envRedirectURI     = "SPOTIFY_REDIRECT_URI"
+	envAPIBaseURL      = "SPOTIFY_API_URL"      // optional: e.g. a local stub server
+	envAccountsBaseURL = "SPOTIFY_ACCOUNTS_URL" // optional: e.g. a local stub server
 	envOutDir          = "OUT_DIR"
+	envDataDir         = "DATA_DIR"            // web mode: where the token, settings and schedule are kept
+	envAllImages       = "DOWNLOAD_ALL_IMAGES" // optional: keep every image size, not just the largest
+	envFollowers       = "FETCH_FOLLOWERS"     // optional: one more request per playlist for its follower count
+	envPlaylistScope   = "PLAYLIST_SCOPE"      // optional: all, owned, followed or collaborative
+	envIncludeName     = "PLAYLIST_INCLUDE_NAME"
+	envExcludeName     = "PLAYLIST_EXCLUDE_NAME"
+	envIncludeIDs      = "PLAYLIST_INCLUDE_IDS"
+	envExcludeIDs      = "PLAYLIST_EXCLUDE_IDS"
+	envPlaylists       = "PLAYLISTS"            // optional: extra playlist URLs/URIs/IDs to back up
+	envPlaylistsFile   = "PLAYLISTS_FILE"       // optional: file with one playlist URL/URI/ID per line
+	envResume          = "RESUME"               // optional: continue an interrupted run
+	envHeadless        = "AUTH_HEADLESS"        // optional: authorize by pasting the redirected URL, no browser or listener
+	envLogFormat       = "LOG_FORMAT"           // optional: text (default) or json
+	envLogLevel        = "LOG_LEVEL"            // optional: debug, info (default), warn or error
+	envNotifyOn        = "NOTIFY_ON"            // optional: always (default) or failure
+	envNotifyTemplate  = "NOTIFY_TEMPLATE_FILE" // optional: text/template for the message body
+	envWebhookURL      = "NOTIFY_WEBHOOK_URL"
+	envNtfyURL         = "NOTIFY_NTFY_URL" // topic URL, e.g. https://ntfy.sh/my-backups
+	envNtfyToken       = "NOTIFY_NTFY_TOKEN"
+	envGotifyURL       = "NOTIFY_GOTIFY_URL"
+	envGotifyToken     = "NOTIFY_GOTIFY_TOKEN"
+	envSMTPAddr        = "NOTIFY_SMTP_ADDR" // host:port
+	envSMTPFrom        = "NOTIFY_SMTP_FROM"
+	envSMTPTo          = "NOTIFY_SMTP_TO" // comma separated
+	envSMTPUsername    = "NOTIFY_SMTP_USERNAME"
+	envSMTPPassword    = "NOTIFY_SMTP_PASSWORD"
+	envAdminPassword   = "WEB_ADMIN_PASSWORD" // web mode: password of the UI
+	envAPIToken        = "WEB_API_TOKEN"      // web mode: bearer token for scripts
+	envUsersFile       = "WEB_USERS_FILE"     // web mode: further users, one name:password per line
 	defaultOutDir      = "./backup"
 	defaultRedirectURI = "http://127.0.0.1:8888/callback"
 	tokenFile          = ".token"
-	userAgent          = "spotify-backup/1.0"
-	sanitizePattern    = regexp.MustCompile(`[^\w\-. ]+`)
-	httpClient         = &http.Client{Timeout: 30 * time.Second}
 )
 
-// Global state for web server mode
-var (
-	appState = &AppState{
-		clientID:     os.Getenv(envClientID),
-		clientSecret: os.Getenv(envClientSecret),
+func main() {
+	logger, err := newLogger(os.Stderr, os.Getenv(envLogFormat), os.Getenv(envLogLevel))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-)
-
-type AppState struct {
-	accessToken  string
-	refreshToken string
-	clientID     string
-	clientSecret string
-	redirectURI  string
-}
+	slog.SetDefault(logger)
 
-type playlistPage struct {
-	Items []playlistItem `json:"items"`
-	Next  string         `json:"next"`
-}
-
-type playlistItem struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Owner       struct {
-		DisplayName string `json:"display_name"`
-		ID          string `json:"id"`
-	} `json:"owner"`
-	Tracks struct {
-		Total int `json:"total"`
-	} `json:"tracks"`
-	Images []struct {
-		URL string `json:"url"`
-	} `json:"images"`
-}
-
-type tracksPage struct {
-	Items []trackItem `json:"items"`
-	Next  string      `json:"next"`
-}
-
-type trackItem struct {
-	AddedAt string `json:"added_at"`
-	Track   track  `json:"track"`
-}
+	// Stop cleanly on Ctrl-C and container stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-type track struct {
-	ID           string            `json:"id"`
-	Name         string            `json:"name"`
-	DurationMs   int               `json:"duration_ms"`
-	Popularity   int               `json:"popularity"`
-	Explicit     bool              `json:"explicit"`
-	PreviewURL   string            `json:"preview_url"`
-	ExternalURLs map[string]string `json:"external_urls"`
-	Artists      []struct {
-		Name string `json:"name"`
-	} `json:"artists"`
-	Album struct {
-		Name string `json:"name"`
-	} `json:"album"`
-}
-
-type savedPlaylist struct {
-	ID          string      `json:"id"`
-	Name        string      `json:"name"`
-	Description string      `json:"description"`
-	Owner       string      `json:"owner"`
-	Image       string      `json:"image,omitempty"`
-	TracksTotal int         `json:"tracks_total"`
-	Tracks      []trackItem `json:"tracks"`
-	SourceURL   string      `json:"source_url"`
-}
+	// Subcommands also work in a web mode container, e.g. through docker exec
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "auth":
+			runAuth(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "stats":
+			runStats(os.Args[2:])
+			return
+		case "restore":
+			runRestore(ctx, os.Args[2:])
+			return
+		}
+	}
 
-func main() {
 	// Check if web server mode is enabled
 	webMode := os.Getenv("WEB_MODE")
 	if webMode == "true" || webMode == "1" {
-		startWebServer()
+		startWebServer(ctx)
 		return
 	}
 
 	// Original CLI mode
-	runCLIMode()
+	runCLIMode(ctx, os.Args[1:])
 }
 
-func runCLIMode() {
-	outDir := os.Getenv(envOutDir)
-	if outDir == "" {
-		outDir = defaultOutDir
+// newLogger builds the process-wide logger from LOG_FORMAT and LOG_LEVEL.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("%s: %w", envLogLevel, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
 	}
+	return nil, fmt.Errorf("%s: unknown format %q, want text or json", envLogFormat, format)
+}
+
+// newSpotifyClient returns a client for the real Spotify endpoints, unless
+// SPOTIFY_API_URL or SPOTIFY_ACCOUNTS_URL override them. Its requests are
+// counted in the metrics.
+func newSpotifyClient() *spotify.Client {
+	c := spotify.NewClient()
+	c.HTTPClient.Transport = metrics.Transport(c.HTTPClient.Transport)
+	c.OnRetry = func(string, time.Duration) { metrics.Retries.Inc() }
+	if v := os.Getenv(envAPIBaseURL); v != "" {
+		c.APIBaseURL = strings.TrimRight(v, "/")
+	}
+	if v := os.Getenv(envAccountsBaseURL); v != "" {
+		c.AccountsBaseURL = strings.TrimRight(v, "/")
+	}
+	return c
+}
+
+func runCLIMode(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("spotify-backup", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [playlist-url-or-id ...]\n", fs.Name())
+		fmt.Fprintf(fs.Output(), "       %s verify [backup-dir]\n", fs.Name())
+		fmt.Fprintf(fs.Output(), "       %s import export.zip [backup-dir]\n", fs.Name())
+		fmt.Fprintf(fs.Output(), "       %s stats [backup-dir]\n", fs.Name())
+		fmt.Fprintf(fs.Output(), "       %s restore [-dry-run] [-playlists ids] [backup-dir]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Backs up the current user's playlists plus any playlists given as arguments.")
+		fs.PrintDefaults()
+	}
+	playlistsFile := fs.String("playlists-file", os.Getenv(envPlaylistsFile), "file with one playlist URL, URI or ID per line")
+	resume := fs.Bool("resume", os.Getenv(envResume) == "true" || os.Getenv(envResume) == "1", "continue an interrupted backup instead of starting over")
+	headless := fs.Bool("headless", os.Getenv(envHeadless) == "true" || os.Getenv(envHeadless) == "1", "authorize by pasting the redirected URL instead of opening a browser and listening for the callback")
+	fs.Parse(args)
+
+	extraIDs, err := extraPlaylistIDs(*playlistsFile, fs.Args())
+	if err != nil {
+		fail(err)
+	}
+	opts, err := backupOptions(backup.Settings{}.Override(backupOverridesFromEnv(extraIDs)))
+	if err != nil {
+		fail(err)
+	}
+	outDir := opts.OutDir
 	if err := os.MkdirAll(outDir, 0o755); err != nil {
 		fail("create outdir:", err)
 	}
 
+	client := newSpotifyClient()
 	accessToken := os.Getenv(envAccessToken)
 	refreshToken := os.Getenv(envRefreshToken)
 	clientID := os.Getenv(envClientID)
@@ -143,16 +194,34 @@ func runCLIMode() {
 
 	// Try to load refresh token from file if not in env
 	if refreshToken == "" {
-		if saved, err := loadRefreshToken(); err == nil && saved != "" {
+		if saved, err := auth.LoadRefreshToken(tokenFile); err == nil && saved != "" {
 			refreshToken = saved
-			fmt.Println("Loaded refresh token from", tokenFile)
+			slog.Info("loaded refresh token", "file", tokenFile)
 		}
 	}
 
+	// Public playlists only and no user tokens: no login needed
+	publicOnly := false
+	if accessToken == "" && refreshToken == "" && clientID != "" && clientSecret != "" && len(extraIDs) > 0 {
+		tok, err := client.ClientCredentialsToken(ctx, clientID, clientSecret)
+		if err != nil {
+			fail("client credentials:", err)
+		}
+		accessToken = tok
+		publicOnly = true
+		slog.Info("got app access token via client credentials, backing up listed playlists only")
+	}
+
 	// If no tokens but have client credentials, do interactive auth
 	if accessToken == "" && refreshToken == "" && clientID != "" && clientSecret != "" {
-		fmt.Println("No tokens found. Starting interactive OAuth flow...")
-		tok, refTok, err := doInteractiveAuth(clientID, clientSecret, redirectURI)
+		slog.Info("no tokens found, starting interactive OAuth flow")
+		var tok, refTok string
+		var err error
+		if *headless {
+			tok, refTok, err = auth.Headless(ctx, client, clientID, clientSecret, redirectURI, auth.Scopes, os.Stdin, os.Stdout)
+		} else {
+			tok, refTok, err = auth.Interactive(ctx, client, clientID, clientSecret, redirectURI, auth.Scopes)
+		}
 		if err != nil {
 			fail("interactive auth failed:", err)
 		}
@@ -160,623 +229,548 @@ func runCLIMode() {
 		refreshToken = refTok
 
 		// Save refresh token to file
-		if err := saveRefreshToken(refreshToken); err != nil {
-			fmt.Fprintf(os.Stderr, "warning: failed to save refresh token: %v\n", err)
+		if err := auth.SaveRefreshToken(tokenFile, refreshToken); err != nil {
+			slog.Warn("failed to save refresh token", "err", err)
 		} else {
-			fmt.Println("✓ Refresh token saved to", tokenFile)
+			slog.Info("refresh token saved", "file", tokenFile)
 		}
 	} else if accessToken == "" && refreshToken != "" && clientID != "" && clientSecret != "" {
-		tok, err := refreshAccessToken(clientID, clientSecret, refreshToken)
+		tok, err := client.RefreshAccessToken(ctx, clientID, clientSecret, refreshToken)
 		if err != nil {
+			metrics.TokenRefreshFailures.Inc()
 			fail("refresh token:", err)
 		}
-		accessToken = tok
-		fmt.Println("Got access token from refresh token")
+		accessToken = tok.AccessToken
+		slog.Info("got access token from refresh token")
 	}
 
 	if accessToken == "" {
 		fail("no SPOTIFY_ACCESS_TOKEN and no refresh token+client credentials provided")
 	}
 
-	playlists, err := fetchAllPlaylists(accessToken)
+	opts.Client = client
+	opts.AccessToken = accessToken
+	opts.PublicOnly = publicOnly
+	opts.Resume = *resume
+	notifier, err := notifierFromEnv()
 	if err != nil {
-		fail("fetch playlists:", err)
+		fail(err)
 	}
-	fmt.Printf("Found %d playlists\n", len(playlists))
-
-	imagesDir := filepath.Join(outDir, "images")
-	_ = os.MkdirAll(imagesDir, 0o755)
-	plistDir := filepath.Join(outDir, "playlists")
-	_ = os.MkdirAll(plistDir, 0o755)
-
-	index := make([]map[string]string, 0, len(playlists))
-
-	for i, p := range playlists {
-		fmt.Printf("[%d/%d] downloading playlist %q (%s)\n", i+1, len(playlists), p.Name, p.ID)
-		tracks, err := fetchAllPlaylistTracks(accessToken, p.ID)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "warning: failed to fetch tracks for %s: %v\n", p.ID, err)
-			continue
-		}
-		sp := savedPlaylist{
-			ID:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			Owner:       p.Owner.DisplayName,
-			TracksTotal: p.Tracks.Total,
-			Tracks:      tracks,
-			SourceURL:   fmt.Sprintf("https://open.spotify.com/playlist/%s", p.ID),
-		}
-		if len(p.Images) > 0 && p.Images[0].URL != "" {
-			sp.Image = p.Images[0].URL
-		}
-
-		fileName := safeFilename(fmt.Sprintf("%s-%s.json", p.Name, p.ID))
-		outPath := filepath.Join(plistDir, fileName)
-		if err := writeJSONFile(outPath, sp); err != nil {
-			fmt.Fprintf(os.Stderr, "warning: failed to write playlist file %s: %v\n", outPath, err)
-			continue
-		}
-
-		// optional: download playlist image
-		if sp.Image != "" {
-			imgExt := ".jpg"
-			u, _ := url.Parse(sp.Image)
-			if u != nil {
-				if ext := filepath.Ext(u.Path); ext != "" && len(ext) <= 5 {
-					imgExt = ext
-				}
-			}
-			imgName := safeFilename(fmt.Sprintf("playlist-%s%s", p.ID, imgExt))
-			imgPath := filepath.Join(imagesDir, imgName)
-			if err := downloadFile(sp.Image, imgPath); err == nil {
-				index = append(index, map[string]string{
-					"id":        p.ID,
-					"name":      p.Name,
-					"file":      filepath.Join("playlists", fileName),
-					"imageFile": filepath.Join("images", imgName),
-				})
-			} else {
-				index = append(index, map[string]string{
-					"id":   p.ID,
-					"name": p.Name,
-					"file": filepath.Join("playlists", fileName),
-				})
-			}
-		} else {
-			index = append(index, map[string]string{
-				"id":   p.ID,
-				"name": p.Name,
-				"file": filepath.Join("playlists", fileName),
-			})
+	res, err := backup.Backup(ctx, opts)
+	fmt.Print(res.Report.Summary())
+	// also report an interrupted run
+	notifier.Send(context.WithoutCancel(ctx), res.Report)
+	if err != nil {
+		if res.Incomplete {
+			fail(err, "- partial index written to", outDir, "(run again with -resume to continue)")
 		}
+		fail(err)
 	}
-
-	// write top-level index
-	indexPath := filepath.Join(outDir, "playlists-index.json")
-	if err := writeJSONFile(indexPath, index); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: failed to write index: %v\n", err)
+	if !res.Report.OK() {
+		// finished, but not everything was backed up
+		slog.Warn("backup finished with failures", "report", filepath.Join(outDir, storage.ReportFile))
+		os.Exit(exitPartial)
 	}
-	fmt.Println("Backup completed. Output dir:", outDir)
+	slog.Info("backup completed", "out_dir", outDir)
 }
 
-// refreshAccessToken exchanges a refresh token for a new access token.
-func refreshAccessToken(clientID, clientSecret, refreshToken string) (string, error) {
-	form := url.Values{}
-	form.Set("grant_type", "refresh_token")
-	form.Set("refresh_token", refreshToken)
-
-	req, _ := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(clientID, clientSecret)
-	req.Header.Set("User-Agent", userAgent)
+// runVerify checks a backup directory against its manifest and exits
+// non-zero if any file is missing or differs.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("spotify-backup verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [backup-dir]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Re-hashes the files of a backup and reports missing, modified or truncated ones.")
+		fmt.Fprintln(fs.Output(), "The directory defaults to OUT_DIR.")
+	}
+	fs.Parse(args)
 
-	resp, err := httpClient.Do(req)
+	dir := backupDir(fs.Arg(0))
+	m, err := storage.ReadManifest(dir)
+	if err != nil {
+		fail("read manifest:", err)
+	}
+	problems, err := storage.Verify(dir, m)
 	if err != nil {
-		return "", err
+		fail("verify:", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("token refresh failed: %s - %s", resp.Status, string(b))
+	fmt.Printf("Backup from %s by spotify-backup %s: %d playlists, %d of %d tracks, %d files\n",
+		m.FinishedAt.Format("2006-01-02 15:04:05 MST"), m.ToolVersion, m.Playlists, m.TracksSaved, m.TracksExpected, len(m.Files))
+	if !m.Complete {
+		fmt.Println("note: the run that wrote this backup was interrupted")
 	}
-	var out struct {
-		AccessToken string `json:"access_token"`
-		Scope       string `json:"scope"`
-		ExpiresIn   int    `json:"expires_in"`
-		TokenType   string `json:"token_type"`
+	for _, c := range m.PlaylistCounts {
+		if c.Mismatch() {
+			fmt.Printf("note: playlist %s has %d of %d tracks\n", c.ID, c.Tracks, c.TracksTotal)
+		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", err
+	for _, p := range problems {
+		fmt.Println(p)
 	}
-	if out.AccessToken == "" {
-		return "", errors.New("no access_token received")
+	if len(problems) > 0 {
+		fail(len(problems), "of", len(m.Files), "files failed verification")
 	}
-	return out.AccessToken, nil
+	fmt.Println("All files verified OK")
 }
 
-func fetchAllPlaylists(accessToken string) ([]playlistItem, error) {
-	var all []playlistItem
-	url := "https://api.spotify.com/v1/me/playlists?limit=50"
-	for url != "" {
-		var page playlistPage
-		if err := apiGetJSON(accessToken, url, &page); err != nil {
-			return nil, err
-		}
-		all = append(all, page.Items...)
-		url = page.Next
+// runImport adds Spotify's account data export to a backup.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("spotify-backup import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export.zip [backup-dir]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Imports the streaming history and library from Spotify's account data export,")
+		fmt.Fprintln(fs.Output(), "the ZIP or the directory it was extracted to, into the backup.")
+		fmt.Fprintln(fs.Output(), "Plays already imported are skipped. The directory defaults to OUT_DIR.")
 	}
-	return all, nil
-}
-
-func fetchAllPlaylistTracks(accessToken, playlistID string) ([]trackItem, error) {
-	var all []trackItem
-	url := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s/tracks?limit=100", playlistID)
-	for url != "" {
-		var page tracksPage
-		if err := apiGetJSON(accessToken, url, &page); err != nil {
-			return nil, err
-		}
-		all = append(all, page.Items...)
-		url = page.Next
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
 	}
-	return all, nil
-}
 
-func apiGetJSON(accessToken, urlStr string, out interface{}) error {
-	req, _ := http.NewRequest("GET", urlStr, nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := httpClient.Do(req)
+	fsys, closeExport, err := accountdata.Open(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer closeExport()
+	data, err := accountdata.Read(fsys)
 	if err != nil {
-		return err
+		fail("read export:", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 401 {
-		return fmt.Errorf("unauthorized - access token expired or invalid")
+	dir := backupDir(fs.Arg(1))
+	res, err := accountdata.Import(dir, data, nil)
+	if err != nil {
+		fail("import:", err)
+	}
+	fmt.Printf("Imported %d files: %d new plays, %d in the history\n", len(data.Files), res.Added, res.Plays)
+	if res.Library {
+		fmt.Println("Replaced the library with the one in the export")
 	}
-	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("spotify api error %s: %s", resp.Status, string(b))
+	for _, f := range res.Written {
+		fmt.Println("wrote", filepath.Join(dir, f))
 	}
-	return json.NewDecoder(resp.Body).Decode(out)
 }
 
-func downloadFile(urlStr, dest string) error {
-	req, _ := http.NewRequest("GET", urlStr, nil)
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
+// runStats prints a summary of the listening history in a backup.
+func runStats(args []string) {
+	fs := flag.NewFlagSet("spotify-backup stats", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of artists, tracks and shows listed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-top n] [backup-dir]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Summarizes the listening history added with the import command.")
+		fmt.Fprintln(fs.Output(), "The directory defaults to OUT_DIR.")
+		fs.PrintDefaults()
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("failed download %s: %s", urlStr, resp.Status)
+	fs.Parse(args)
+
+	dir := backupDir(fs.Arg(0))
+	h, err := storage.ReadHistory(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		fail("no listening history in", dir+"; add it with the import command")
 	}
-	f, err := os.Create(dest)
 	if err != nil {
-		return err
+		fail("read history:", err)
+	}
+	st := accountdata.Summarize(h.Plays, *top)
+	if st.Plays == 0 {
+		fmt.Println("The listening history is empty")
+		return
+	}
+	fmt.Printf("%d plays from %s to %s, %.1f hours listened\n",
+		st.Plays, st.First.Format("2006-01-02"), st.Last.Format("2006-01-02"), st.TimePlayed.Hours())
+	list := func(title string, counts []accountdata.Count) {
+		if len(counts) == 0 {
+			return
+		}
+		fmt.Printf("\n%s:\n", title)
+		for i, c := range counts {
+			fmt.Printf("%3d. %s (%d plays, %.1f h)\n", i+1, c.Name, c.Plays, c.TimePlayed.Hours())
+		}
 	}
-	defer f.Close()
-	_, err = io.Copy(f, resp.Body)
-	return err
+	list("Top artists", st.TopArtists)
+	list("Top tracks", st.TopTracks)
+	list("Top shows", st.TopShows)
 }
 
-func writeJSONFile(path string, v interface{}) error {
-	tmp := path + ".tmp"
-	f, err := os.Create(tmp)
+// runRestore re-follows and recreates the playlists of a backup that are no
+// longer in the library.
+func runRestore(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("spotify-backup restore", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only list what would be restored")
+	playlists := fs.String("playlists", "", "comma separated playlist URLs, URIs or IDs of the backup to restore instead of all")
+	headless := fs.Bool("headless", os.Getenv(envHeadless) == "true" || os.Getenv(envHeadless) == "1", "authorize by pasting the redirected URL instead of opening a browser and listening for the callback")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [backup-dir]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Follows the backed up playlists of others again and recreates your own")
+		fmt.Fprintln(fs.Output(), "from their saved tracks, skipping those still in the library.")
+		fmt.Fprintln(fs.Output(), "Needs permission to modify playlists, which is asked for if the saved")
+		fmt.Fprintln(fs.Output(), "token lacks it. The directory defaults to OUT_DIR.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var ids []string
+	for _, ref := range strings.FieldsFunc(*playlists, func(r rune) bool { return r == ',' || r == ' ' }) {
+		id, err := spotify.ParsePlaylistRef(ref)
+		if err != nil {
+			fail(err)
+		}
+		ids = append(ids, id)
+	}
+	client := newSpotifyClient()
+	accessToken := os.Getenv(envAccessToken)
+	if accessToken == "" {
+		accessToken = restoreAccessToken(ctx, client, *headless, *dryRun)
+	}
+	res, err := backup.Restore(ctx, backup.RestoreOptions{
+		Client:      client,
+		AccessToken: accessToken,
+		Dir:         backupDir(fs.Arg(0)),
+		IDs:         ids,
+		DryRun:      *dryRun,
+	})
+	if res != nil {
+		fmt.Print(res.Summary())
+	}
 	if err != nil {
-		return err
+		fail("restore:", err)
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(v); err != nil {
-		f.Close()
-		return err
+	if len(res.Failures) > 0 {
+		os.Exit(exitPartial)
 	}
-	f.Close()
-	return os.Rename(tmp, path)
 }
 
-func safeFilename(name string) string {
-	name = strings.TrimSpace(name)
-	name = sanitizePattern.ReplaceAllString(name, "_")
-	if len(name) > 200 {
-		name = name[:200]
+// restoreAccessToken returns an access token from the saved refresh token
+// if it was granted auth.RestoreScopes, or for a dry run any scopes, and
+// authorizes again otherwise, saving the new refresh token.
+func restoreAccessToken(ctx context.Context, client *spotify.Client, headless, dryRun bool) string {
+	clientID, clientSecret := os.Getenv(envClientID), os.Getenv(envClientSecret)
+	if clientID == "" || clientSecret == "" {
+		fail("restore needs SPOTIFY_ACCESS_TOKEN or SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+	}
+	refreshToken := os.Getenv(envRefreshToken)
+	if refreshToken == "" {
+		refreshToken, _ = auth.LoadRefreshToken(tokenFile)
+	}
+	if refreshToken != "" {
+		tok, err := client.RefreshAccessToken(ctx, clientID, clientSecret, refreshToken)
+		switch {
+		case err != nil:
+			metrics.TokenRefreshFailures.Inc()
+			slog.Warn("refresh token failed, authorizing again", "err", err)
+		case dryRun || hasScopes(tok.Scope, auth.RestoreScopes):
+			return tok.AccessToken
+		default:
+			slog.Info("the saved token may not modify playlists, authorizing again")
+		}
 	}
-	return name
-}
 
-func fail(v ...interface{}) {
-	fmt.Fprintln(os.Stderr, v...)
-	os.Exit(1)
+	redirectURI := os.Getenv(envRedirectURI)
+	if redirectURI == "" {
+		redirectURI = defaultRedirectURI
+	}
+	var accessToken string
+	var err error
+	if headless {
+		accessToken, refreshToken, err = auth.Headless(ctx, client, clientID, clientSecret, redirectURI, auth.RestoreScopes, os.Stdin, os.Stdout)
+	} else {
+		accessToken, refreshToken, err = auth.Interactive(ctx, client, clientID, clientSecret, redirectURI, auth.RestoreScopes)
+	}
+	if err != nil {
+		fail("interactive auth failed:", err)
+	}
+	// the new token covers backups too
+	if err := auth.SaveRefreshToken(tokenFile, refreshToken); err != nil {
+		slog.Warn("failed to save refresh token", "err", err)
+	} else {
+		slog.Info("refresh token saved", "file", tokenFile)
+	}
+	return accessToken
 }
 
-// loadRefreshToken reads the refresh token from the local token file if present.
-func loadRefreshToken() (string, error) {
-	b, err := os.ReadFile(tokenFile)
-	if err != nil {
-		return "", err
+// hasScopes reports whether the space separated granted scopes include
+// every one of want.
+func hasScopes(granted, want string) bool {
+	have := strings.Fields(granted)
+	for _, s := range strings.Fields(want) {
+		if !slices.Contains(have, s) {
+			return false
+		}
 	}
-	return strings.TrimSpace(string(b)), nil
+	return true
 }
 
-// saveRefreshToken persists the refresh token to the local token file.
-func saveRefreshToken(tok string) error {
-	tok = strings.TrimSpace(tok)
-	if tok == "" {
-		return errors.New("empty refresh token")
+// backupDir returns the backup directory given on the command line,
+// defaulting to OUT_DIR.
+func backupDir(arg string) string {
+	if arg != "" {
+		return arg
+	}
+	if dir := os.Getenv(envOutDir); dir != "" {
+		return dir
 	}
-	return os.WriteFile(tokenFile, []byte(tok+"\n"), 0o600)
+	return defaultOutDir
 }
 
-// doInteractiveAuth implements the authorization code flow with local server
-func doInteractiveAuth(clientID, clientSecret, redirectURI string) (accessToken, refreshToken string, err error) {
-	// Parse port from redirect URI
-	u, _ := url.Parse(redirectURI)
-	port := u.Port()
-	if port == "" {
-		port = "8888"
-	}
-
-	scopes := "playlist-read-private playlist-read-collaborative user-library-read"
-	authURL := fmt.Sprintf(
-		"https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s",
-		url.QueryEscape(clientID),
-		url.QueryEscape(redirectURI),
-		url.QueryEscape(scopes),
-	)
-
-	// Channel to receive the authorization code
-	codeChan := make(chan string, 1)
-	errChan := make(chan error, 1)
-
-	// Start local HTTP server
-	srv := &http.Server{Addr: ":" + port}
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			errChan <- errors.New("no code in callback")
-			fmt.Fprintf(w, "<html><body><h1>Error: No authorization code received</h1></body></html>")
-			return
+// extraPlaylistIDs collects the playlists listed in PLAYLISTS, in
+// playlistsFile and in args.
+func extraPlaylistIDs(playlistsFile string, args []string) ([]string, error) {
+	refs := append(strings.Fields(strings.ReplaceAll(os.Getenv(envPlaylists), ",", " ")), args...)
+	if playlistsFile != "" {
+		fromFile, err := readPlaylistRefsFile(playlistsFile)
+		if err != nil {
+			return nil, fmt.Errorf("read playlists file: %w", err)
 		}
-		codeChan <- code
-		fmt.Fprintf(w, "<html><body><h1>✓ Authorization successful!</h1><p>You can close this window and return to the terminal.</p></body></html>")
-	})
-
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errChan <- fmt.Errorf("server error: %w", err)
+		refs = append(refs, fromFile...)
+	}
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		id, err := spotify.ParsePlaylistRef(ref)
+		if err != nil {
+			return nil, err
 		}
-	}()
-
-	fmt.Println("Starting Spotify authorization...")
-	fmt.Println("Opening browser for authentication...")
-
-	// Open browser automatically
-	if err := openBrowser(authURL); err != nil {
-		fmt.Println("\nCouldn't open browser automatically. Please open this URL manually:")
-		fmt.Printf("\n   %s\n\n", authURL)
+		ids = append(ids, id)
 	}
+	return ids, nil
+}
 
-	fmt.Println("Waiting for authorization...")
-
-	var code string
-	select {
-	case code = <-codeChan:
-		fmt.Println("✓ Authorization successful")
-	case err := <-errChan:
-		return "", "", err
-	case <-time.After(5 * time.Minute):
-		return "", "", errors.New("timeout waiting for authorization")
+// runAuth manages the stored Spotify authorization.
+func runAuth(args []string) {
+	fs := flag.NewFlagSet("spotify-backup auth logout", flag.ExitOnError)
+	resetCredentials := fs.Bool("reset-credentials", false, "also remove the client ID and secret saved by web mode")
+	webUser := fs.String("user", "", "web mode user to log out instead of the admin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-reset-credentials] [-user name]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Deletes the stored refresh token, disconnecting the Spotify account.")
+		fmt.Fprintln(fs.Output(), "A running web server keeps its tokens until restarted; use POST /api/auth/logout instead.")
+		fs.PrintDefaults()
 	}
-
-	// Shutdown server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	srv.Shutdown(ctx)
-
-	// Exchange code for tokens
-	form := url.Values{}
-	form.Set("grant_type", "authorization_code")
-	form.Set("code", code)
-	form.Set("redirect_uri", redirectURI)
-
-	req, _ := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(clientID, clientSecret)
-	req.Header.Set("User-Agent", userAgent)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", "", err
+	if len(args) == 0 || args[0] != "logout" {
+		fs.Usage()
+		os.Exit(2)
 	}
-	defer resp.Body.Close()
+	fs.Parse(args[1:])
 
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return "", "", fmt.Errorf("token exchange failed: %s - %s", resp.Status, string(b))
+	dataDir := os.Getenv(envDataDir)
+	if dataDir == "" {
+		dataDir = "."
+	}
+	tokenPath, settingsFile := filepath.Join(dataDir, tokenFile), filepath.Join(dataDir, server.SettingsFile)
+	if *webUser != "" {
+		home := filepath.Join(dataDir, "users", *webUser)
+		tokenPath, settingsFile = filepath.Join(home, ".token"), filepath.Join(home, server.SettingsFile)
 	}
 
-	var out struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		TokenType    string `json:"token_type"`
-		Scope        string `json:"scope"`
+	if err := auth.DeleteRefreshToken(tokenPath); err != nil {
+		fail("delete refresh token:", err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", "", err
+	fmt.Println("Deleted the refresh token in", tokenPath)
+	if !*resetCredentials {
+		return
 	}
-
-	if out.AccessToken == "" || out.RefreshToken == "" {
-		return "", "", errors.New("no tokens received")
+	settings, err := server.LoadSettings(settingsFile)
+	if err != nil {
+		fail(err)
+	}
+	settings.ClientID, settings.ClientSecret = "", ""
+	if err := server.SaveSettings(settingsFile, settings); err != nil {
+		fail("save settings:", err)
+	}
+	fmt.Println("Removed the client credentials from", settingsFile)
+	if os.Getenv(envClientID) != "" {
+		fmt.Println("note:", envClientID, "is still set in the environment")
 	}
-
-	return out.AccessToken, out.RefreshToken, nil
-}
-
-// openBrowser opens the specified URL in the default browser
-func openBrowser(url string) error {
-	var cmd string
-	var args []string
-
-	switch runtime.GOOS {
-	case "windows":
-		cmd = "cmd"
-		args = []string{"/c", "start"}
-	case "darwin":
-		cmd = "open"
-	default: // "linux", "freebsd", "openbsd", "netbsd"
-		cmd = "xdg-open"
-	}
-	args = append(args, url)
-	return exec.Command(cmd, args...).Start()
 }
 
-// Web server functionality
-
-func startWebServer() {
-	mime.AddExtensionType(".js", "text/javascript")
-	mime.AddExtensionType(".mjs", "text/javascript")
-	mime.AddExtensionType(".css", "text/css")
-	mime.AddExtensionType(".wasm", "application/wasm")
-
-	// Load any existing tokens
-	if rt, err := loadRefreshToken(); err == nil && rt != "" {
-		appState.refreshToken = rt
-		fmt.Println("Loaded refresh token from", tokenFile)
+// backupOverridesFromEnv returns the backup settings shared by CLI and web
+// mode that are set in the environment, even if set to an empty value.
+// extraIDs override when any were given or PLAYLISTS or PLAYLISTS_FILE is set.
+func backupOverridesFromEnv(extraIDs []string) backup.Overrides {
+	lookup := func(key string) *string {
+		if v, ok := os.LookupEnv(key); ok {
+			return &v
+		}
+		return nil
 	}
-
-	redirectURI := os.Getenv(envRedirectURI)
-	if redirectURI == "" {
-		redirectURI = defaultRedirectURI
+	o := backup.Overrides{
+		OutDir:      lookup(envOutDir),
+		Scope:       lookup(envPlaylistScope),
+		IncludeName: lookup(envIncludeName),
+		ExcludeName: lookup(envExcludeName),
+		IncludeIDs:  lookup(envIncludeIDs),
+		ExcludeIDs:  lookup(envExcludeIDs),
 	}
-	appState.redirectURI = redirectURI
-
-	gin.SetMode(gin.ReleaseMode)
-	r := setupWebServer()
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if v := lookup(envAllImages); v != nil {
+		all := *v == "true" || *v == "1"
+		o.AllImages = &all
 	}
-
-	fmt.Printf("Starting web server on port %s...\n", port)
-	if err := r.Run(":" + port); err != nil {
-		fail("failed to start web server:", err)
+	if v := lookup(envFollowers); v != nil {
+		followers := *v == "true" || *v == "1"
+		o.Followers = &followers
 	}
+	if len(extraIDs) > 0 || lookup(envPlaylists) != nil || lookup(envPlaylistsFile) != nil {
+		o.ExtraIDs = &extraIDs
+	}
+	return o
 }
 
-func setupWebServer() *gin.Engine {
-	r := gin.Default()
-
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:4200", "http://localhost:8080"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		AllowCredentials: true,
-	}))
-
-	api := r.Group("/api")
-	{
-		api.GET("/status", handleStatus)
-		api.POST("/auth/setup", handleAuthSetup)
-		api.GET("/auth/callback", handleAuthCallback)
-		api.POST("/auth/start", handleAuthStart)
+// backupOptions builds the options of settings, filling in the defaults.
+// Client and AccessToken are left to the caller.
+func backupOptions(settings backup.Settings) (backup.Options, error) {
+	if settings.OutDir == "" {
+		settings.OutDir = defaultOutDir
 	}
+	opts, err := settings.Options()
+	if err != nil {
+		return backup.Options{}, err
+	}
+	opts.ToolVersion = version
+	return opts, nil
+}
 
-	// Serve favicon (if present)
-	r.StaticFile("/favicon.ico", "./public/favicon.ico")
-
-	// Explicit root route to serve the SPA entry
-	r.GET("/", func(c *gin.Context) {
-		c.File("./public/index.html")
-	})
-
-	r.NoRoute(func(c *gin.Context) {
-		p := c.Request.URL.Path
-		if strings.HasPrefix(p, "/api") {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
+// notifierFromEnv configures a notifier for every NOTIFY_* destination set.
+func notifierFromEnv() (*notify.Dispatcher, error) {
+	d := &notify.Dispatcher{}
+	switch on := os.Getenv(envNotifyOn); on {
+	case "", "always":
+	case "failure":
+		d.OnlyFailures = true
+	default:
+		return nil, fmt.Errorf("%s: unknown value %q, want always or failure", envNotifyOn, on)
+	}
+	if path := os.Getenv(envNotifyTemplate); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envNotifyTemplate, err)
 		}
-
-		clean := path.Clean(p)
-		if clean == "/" {
-			c.File("./public/index.html")
-			return
+		if d.Template, err = notify.ParseTemplate(string(b)); err != nil {
+			return nil, fmt.Errorf("%s: %w", envNotifyTemplate, err)
 		}
+	}
 
-		local := filepath.Join("public", strings.TrimPrefix(clean, "/"))
-		if info, err := os.Stat(local); err == nil && !info.IsDir() {
-			c.File(local)
-			return
+	if u := os.Getenv(envWebhookURL); u != "" {
+		d.Notifiers = append(d.Notifiers, notify.Webhook{URL: u})
+	}
+	if u := os.Getenv(envNtfyURL); u != "" {
+		d.Notifiers = append(d.Notifiers, notify.Ntfy{URL: u, Token: os.Getenv(envNtfyToken)})
+	}
+	if u := os.Getenv(envGotifyURL); u != "" {
+		d.Notifiers = append(d.Notifiers, notify.Gotify{URL: u, Token: os.Getenv(envGotifyToken)})
+	}
+	if addr := os.Getenv(envSMTPAddr); addr != "" {
+		to := strings.FieldsFunc(os.Getenv(envSMTPTo), func(r rune) bool { return r == ',' || r == ' ' })
+		if len(to) == 0 || os.Getenv(envSMTPFrom) == "" {
+			return nil, fmt.Errorf("%s needs %s and %s", envSMTPAddr, envSMTPFrom, envSMTPTo)
 		}
-
-		c.File("./public/index.html")
-	})
-
-	return r
-}
-
-// API Response types
-type StatusResponse struct {
-	HasToken    bool   `json:"hasToken"`
-	HasClientID bool   `json:"hasClientId"`
-	NeedsSetup  bool   `json:"needsSetup"`
-	Message     string `json:"message"`
-}
-
-type AuthSetupRequest struct {
-	ClientID     string `json:"clientId" binding:"required"`
-	ClientSecret string `json:"clientSecret" binding:"required"`
+		d.Notifiers = append(d.Notifiers, notify.SMTP{
+			Addr:     addr,
+			From:     os.Getenv(envSMTPFrom),
+			To:       to,
+			Username: os.Getenv(envSMTPUsername),
+			Password: os.Getenv(envSMTPPassword),
+		})
+	}
+	return d, nil
 }
 
-type AuthSetupResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	AuthURL string `json:"authUrl,omitempty"`
+// readPlaylistRefsFile reads playlist references one per line, skipping blank
+// lines and # comments.
+func readPlaylistRefsFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		refs = append(refs, line)
+	}
+	return refs, nil
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// fail logs v as an error and exits.
+func fail(v ...interface{}) {
+	slog.Error(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	os.Exit(1)
 }
 
-// handleStatus checks if there's a valid token or if setup is needed
-func handleStatus(c *gin.Context) {
-	hasToken := appState.accessToken != "" || appState.refreshToken != ""
-	hasClientID := appState.clientID != ""
-
-	resp := StatusResponse{
-		HasToken:    hasToken,
-		HasClientID: hasClientID,
-		NeedsSetup:  !hasClientID,
+func startWebServer(ctx context.Context) {
+	extraIDs, err := extraPlaylistIDs(os.Getenv(envPlaylistsFile), nil)
+	if err != nil {
+		fail(err)
 	}
-
-	if !hasClientID {
-		resp.Message = "Please provide Spotify client ID and secret to begin"
-	} else if !hasToken {
-		resp.Message = "Client credentials configured. Ready to authenticate with Spotify"
-	} else {
-		resp.Message = "Authentication complete. Ready to backup playlists"
+	dataDir := os.Getenv(envDataDir)
+	if dataDir == "" {
+		dataDir = "."
 	}
 
-	c.JSON(http.StatusOK, resp)
-}
-
-// handleAuthSetup receives client ID and secret from UI and initiates auth flow
-func handleAuthSetup(c *gin.Context) {
-	var req AuthSetupRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request: " + err.Error()})
-		return
+	// settings saved by an earlier run, with those set in the environment
+	// taking precedence
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		fail(err)
 	}
-
-	// Store credentials
-	appState.clientID = req.ClientID
-	appState.clientSecret = req.ClientSecret
-
-	// Generate auth URL
-	scopes := "playlist-read-private playlist-read-collaborative user-library-read"
-	authURL := fmt.Sprintf(
-		"https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s",
-		url.QueryEscape(req.ClientID),
-		url.QueryEscape(appState.redirectURI),
-		url.QueryEscape(scopes),
-	)
-
-	c.JSON(http.StatusOK, AuthSetupResponse{
-		Success: true,
-		Message: "Client credentials saved. Please authorize the application",
-		AuthURL: authURL,
-	})
-}
-
-// handleAuthStart initiates the OAuth flow
-func handleAuthStart(c *gin.Context) {
-	if appState.clientID == "" || appState.clientSecret == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Client credentials not configured"})
-		return
+	settingsFile := filepath.Join(dataDir, server.SettingsFile)
+	saved, err := server.LoadSettings(settingsFile)
+	if err != nil {
+		fail(err)
 	}
-
-	scopes := "playlist-read-private playlist-read-collaborative user-library-read"
-	authURL := fmt.Sprintf(
-		"https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s",
-		url.QueryEscape(appState.clientID),
-		url.QueryEscape(appState.redirectURI),
-		url.QueryEscape(scopes),
-	)
-
-	c.JSON(http.StatusOK, gin.H{
-		"authUrl": authURL,
-		"message": "Please visit the auth URL to authorize the application",
+	settings := saved.Override(server.Overrides{
+		ClientID:     os.Getenv(envClientID),
+		ClientSecret: os.Getenv(envClientSecret),
+		RedirectURI:  os.Getenv(envRedirectURI),
+		Backup:       backupOverridesFromEnv(extraIDs),
 	})
-}
-
-// handleAuthCallback receives the OAuth callback with authorization code
-func handleAuthCallback(c *gin.Context) {
-	code := c.Query("code")
-	if code == "" {
-		c.HTML(http.StatusBadRequest, "", gin.H{})
-		c.Writer.WriteString("<html><body><h1>Error: No authorization code received</h1></body></html>")
-		return
+	if err := server.SaveSettings(settingsFile, settings); err != nil {
+		fail(err)
 	}
-
-	// Exchange code for tokens
-	form := url.Values{}
-	form.Set("grant_type", "authorization_code")
-	form.Set("code", code)
-	form.Set("redirect_uri", appState.redirectURI)
-
-	req, _ := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(appState.clientID, appState.clientSecret)
-	req.Header.Set("User-Agent", userAgent)
-
-	resp, err := httpClient.Do(req)
+	opts, err := backupOptions(*settings.Backup)
 	if err != nil {
-		c.Writer.WriteString(fmt.Sprintf("<html><body><h1>Error</h1><p>Failed to exchange authorization code: %s</p></body></html>", err.Error()))
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		c.Writer.WriteString(fmt.Sprintf("<html><body><h1>Error</h1><p>Token exchange failed: %s - %s</p></body></html>", resp.Status, string(b)))
-		return
+		fail(err)
 	}
-
-	var out struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		TokenType    string `json:"token_type"`
-		Scope        string `json:"scope"`
+	notifier, err := notifierFromEnv()
+	if err != nil {
+		fail(err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		c.Writer.WriteString(fmt.Sprintf("<html><body><h1>Error</h1><p>Failed to decode token response: %s</p></body></html>", err.Error()))
-		return
+	var users map[string]string
+	if f := os.Getenv(envUsersFile); f != "" {
+		if users, err = server.ReadUsersFile(f); err != nil {
+			fail(err)
+		}
 	}
 
-	if out.AccessToken == "" || out.RefreshToken == "" {
-		c.Writer.WriteString("<html><body><h1>Error</h1><p>No tokens received from Spotify</p></body></html>")
-		return
+	srv, err := server.New(server.Config{
+		Client:       newSpotifyClient(),
+		ClientID:     settings.ClientID,
+		ClientSecret: settings.ClientSecret,
+		RedirectURI:  settings.RedirectURI,
+		TokenFile:    filepath.Join(dataDir, tokenFile),
+		PublicDir:    "./public",
+		Backup:       opts,
+		Notifier:     notifier,
+		ScheduleFile: filepath.Join(dataDir, "schedule.json"),
+		SettingsFile: settingsFile,
+
+		AdminPassword: os.Getenv(envAdminPassword),
+		APIToken:      os.Getenv(envAPIToken),
+		Users:         users,
+		UsersDir:      filepath.Join(dataDir, "users"),
+	})
+	if err != nil {
+		fail(err)
 	}
 
-	// Store tokens
-	appState.accessToken = out.AccessToken
-	appState.refreshToken = out.RefreshToken
-
-	// Save refresh token to file
-	if err := saveRefreshToken(out.RefreshToken); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: failed to save refresh token: %v\n", err)
-	} else {
-		fmt.Println("✓ Refresh token saved to", tokenFile)
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
 	}
 
-	// Return success page
-	c.Header("Content-Type", "text/html")
-	c.Writer.WriteString("<html><body><h1>✓ Authorization successful!</h1><p>You can close this window and return to the application.</p></body></html>")
+	slog.Info("starting web server", "port", port)
+	if err := srv.Run(ctx, ":"+port); err != nil {
+		fail("failed to start web server:", err)
+	}
 }
@@ -0,0 +1,390 @@
+// Package spotify is a small client for the parts of the Spotify Web API and
+// accounts service that spotify-backup uses.
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAPIBaseURL      = "https://api.spotify.com/v1"
+	DefaultAccountsBaseURL = "https://accounts.spotify.com"
+	UserAgent              = "spotify-backup/1.0"
+)
+
+// ErrUnauthorized is returned for API requests rejected with 401.
+var ErrUnauthorized = errors.New("unauthorized - access token expired or invalid")
+
+// ErrInvalidGrant is returned when the token endpoint rejects a code or
+// refresh token, e.g. because the user revoked the app's access.
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// Client talks to the Spotify Web API and accounts service. The base URLs
+// are configurable so the tool can be pointed at a local stub server.
+type Client struct {
+	APIBaseURL      string // e.g. https://api.spotify.com/v1
+	AccountsBaseURL string // e.g. https://accounts.spotify.com
+	HTTPClient      *http.Client
+	MaxRetries      int // attempts to repeat a request rate limited with 429
+	// OnRetry, if set, is called before a rate limited request is repeated.
+	OnRetry func(urlStr string, wait time.Duration)
+}
+
+// NewClient returns a client for the real Spotify endpoints.
+func NewClient() *Client {
+	return &Client{
+		APIBaseURL:      DefaultAPIBaseURL,
+		AccountsBaseURL: DefaultAccountsBaseURL,
+		HTTPClient:      &http.Client{Timeout: 30 * time.Second},
+		MaxRetries:      5,
+	}
+}
+
+// AuthorizeURL builds the URL the user visits to grant the app access.
+// A non-empty state is passed back unchanged to the redirect URI.
+func (c *Client) AuthorizeURL(clientID, redirectURI, scopes, state string) string {
+	u := fmt.Sprintf(
+		"%s/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s",
+		c.AccountsBaseURL,
+		url.QueryEscape(clientID),
+		url.QueryEscape(redirectURI),
+		url.QueryEscape(scopes),
+	)
+	if state != "" {
+		u += "&state=" + url.QueryEscape(state)
+	}
+	return u
+}
+
+// requestToken posts a grant to the token endpoint.
+func (c *Client) requestToken(ctx context.Context, clientID, clientSecret string, form url.Values) (*Token, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.AccountsBaseURL+"/api/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error == "invalid_grant" {
+			return nil, fmt.Errorf("%w: %s - %s", ErrInvalidGrant, resp.Status, string(b))
+		}
+		return nil, fmt.Errorf("%s - %s", resp.Status, string(b))
+	}
+	var out Token
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("no access_token received")
+	}
+	return &out, nil
+}
+
+// RefreshAccessToken exchanges a refresh token for a new access token. The
+// returned token carries the granted scopes but usually no refresh token.
+func (c *Client) RefreshAccessToken(ctx context.Context, clientID, clientSecret, refreshToken string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	out, err := c.requestToken(ctx, clientID, clientSecret, form)
+	if err != nil {
+		return nil, fmt.Errorf("token refresh failed: %w", err)
+	}
+	return out, nil
+}
+
+// ExchangeCode trades an authorization code for access and refresh tokens.
+func (c *Client) ExchangeCode(ctx context.Context, clientID, clientSecret, code, redirectURI string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+
+	out, err := c.requestToken(ctx, clientID, clientSecret, form)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+	if out.RefreshToken == "" {
+		return nil, errors.New("no tokens received")
+	}
+	return out, nil
+}
+
+// ClientCredentialsToken obtains an app-only access token. It needs no user
+// interaction but can only read public data.
+func (c *Client) ClientCredentialsToken(ctx context.Context, clientID, clientSecret string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+
+	out, err := c.requestToken(ctx, clientID, clientSecret, form)
+	if err != nil {
+		return "", fmt.Errorf("client credentials grant failed: %w", err)
+	}
+	return out.AccessToken, nil
+}
+
+// FetchCurrentUserID returns the Spotify user ID the token belongs to.
+func (c *Client) FetchCurrentUserID(ctx context.Context, accessToken string) (string, error) {
+	me, err := c.FetchCurrentUser(ctx, accessToken)
+	if err != nil {
+		return "", err
+	}
+	return me.ID, nil
+}
+
+// FetchCurrentUser returns the profile of the user the token belongs to.
+func (c *Client) FetchCurrentUser(ctx context.Context, accessToken string) (*User, error) {
+	var me User
+	if err := c.GetJSON(ctx, accessToken, "/me", &me); err != nil {
+		return nil, err
+	}
+	return &me, nil
+}
+
+// FetchAllPlaylists pages through the playlists in the user's library, both
+// owned and followed.
+func (c *Client) FetchAllPlaylists(ctx context.Context, accessToken string) ([]Playlist, error) {
+	var all []Playlist
+	url := c.APIBaseURL + "/me/playlists?limit=50"
+	for url != "" {
+		var page playlistPage
+		if err := c.GetJSON(ctx, accessToken, url, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Items...)
+		url = page.Next
+	}
+	return all, nil
+}
+
+// FetchPlaylist loads the metadata of a single playlist by ID, which works for
+// any public playlist whether or not the user follows it.
+func (c *Client) FetchPlaylist(ctx context.Context, accessToken, playlistID string) (*Playlist, error) {
+	fields := "id,name,description,public,collaborative,snapshot_id,owner(id,display_name),tracks.total,images,followers.total"
+	var p Playlist
+	if err := c.GetJSON(ctx, accessToken, fmt.Sprintf("/playlists/%s?fields=%s", playlistID, url.QueryEscape(fields)), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// FetchPlaylistFollowers reads the follower count, which the simplified
+// playlist objects returned by /me/playlists leave out.
+func (c *Client) FetchPlaylistFollowers(ctx context.Context, accessToken, playlistID string) (int, error) {
+	var out struct {
+		Followers struct {
+			Total int `json:"total"`
+		} `json:"followers"`
+	}
+	if err := c.GetJSON(ctx, accessToken, fmt.Sprintf("/playlists/%s?fields=followers.total", playlistID), &out); err != nil {
+		return 0, err
+	}
+	return out.Followers.Total, nil
+}
+
+// FollowPlaylist adds a playlist to the user's library. public controls
+// whether it is listed on their profile.
+func (c *Client) FollowPlaylist(ctx context.Context, accessToken, playlistID string, public bool) error {
+	return c.doJSON(ctx, "PUT", accessToken, fmt.Sprintf("/playlists/%s/followers", playlistID), map[string]bool{"public": public}, nil)
+}
+
+// NewPlaylist describes a playlist to create.
+type NewPlaylist struct {
+	Name          string `json:"name"`
+	Description   string `json:"description,omitempty"`
+	Public        bool   `json:"public"`
+	Collaborative bool   `json:"collaborative"` // Spotify requires Public to be false
+}
+
+// CreatePlaylist creates an empty playlist owned by the user.
+func (c *Client) CreatePlaylist(ctx context.Context, accessToken, userID string, p NewPlaylist) (*Playlist, error) {
+	var out Playlist
+	if err := c.doJSON(ctx, "POST", accessToken, fmt.Sprintf("/users/%s/playlists", url.PathEscape(userID)), p, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MaxTracksPerRequest is how many items AddPlaylistTracks sends at once.
+const MaxTracksPerRequest = 100
+
+// AddPlaylistTracks appends the track and episode URIs to a playlist, in
+// requests of at most MaxTracksPerRequest.
+func (c *Client) AddPlaylistTracks(ctx context.Context, accessToken, playlistID string, uris []string) error {
+	for chunk := range slices.Chunk(uris, MaxTracksPerRequest) {
+		if err := c.doJSON(ctx, "POST", accessToken, fmt.Sprintf("/playlists/%s/tracks", playlistID), map[string][]string{"uris": chunk}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchAllPlaylistTracks pages through every track item of a playlist.
+func (c *Client) FetchAllPlaylistTracks(ctx context.Context, accessToken, playlistID string) ([]TrackItem, error) {
+	var all []TrackItem
+	url := c.PlaylistTracksURL(playlistID)
+	for url != "" {
+		items, next, err := c.FetchPlaylistTracksPage(ctx, accessToken, url)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		url = next
+	}
+	return all, nil
+}
+
+// PlaylistTracksURL is the URL of the first page of a playlist's tracks.
+func (c *Client) PlaylistTracksURL(playlistID string) string {
+	return fmt.Sprintf("%s/playlists/%s/tracks?limit=100", c.APIBaseURL, playlistID)
+}
+
+// FetchPlaylistTracksPage fetches one page of track items and returns the
+// URL of the next page, which is empty after the last one.
+func (c *Client) FetchPlaylistTracksPage(ctx context.Context, accessToken, urlStr string) ([]TrackItem, string, error) {
+	var page tracksPage
+	if err := c.GetJSON(ctx, accessToken, urlStr, &page); err != nil {
+		return nil, "", err
+	}
+	return page.Items, page.Next, nil
+}
+
+// GetJSON fetches an API resource. urlStr is either an absolute URL, such as
+// a paging "next" link, or a path relative to the API base URL.
+func (c *Client) GetJSON(ctx context.Context, accessToken, urlStr string, out interface{}) error {
+	return c.doJSON(ctx, "GET", accessToken, urlStr, nil, out)
+}
+
+// doJSON sends a request with in, if not nil, as its JSON body and decodes
+// the response into out, if not nil. Rate limited requests are repeated.
+func (c *Client) doJSON(ctx context.Context, method, accessToken, urlStr string, in, out interface{}) error {
+	if strings.HasPrefix(urlStr, "/") {
+		urlStr = c.APIBaseURL + urlStr
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, urlStr, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("User-Agent", UserAgent)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err = c.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= c.MaxRetries {
+			break
+		}
+		resp.Body.Close()
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if c.OnRetry != nil {
+			c.OnRetry(urlStr, wait)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("spotify api error %s: %s", resp.Status, string(b))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// retryAfter converts a Retry-After header in seconds to a wait duration.
+func retryAfter(header string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || secs < 0 {
+		return time.Second
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DownloadFile saves the resource at urlStr, typically a cover image, to
+// dest. The file only appears once it was downloaded completely.
+func (c *Client) DownloadFile(ctx context.Context, urlStr, dest string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed download %s: %s", urlStr, resp.Status)
+	}
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
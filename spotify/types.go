@@ -0,0 +1,159 @@
+package spotify
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var playlistIDPattern = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+
+// Token is the body returned by the accounts service token endpoint.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+// User is a Spotify user profile as returned by /me.
+type User struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+type playlistPage struct {
+	Items []Playlist `json:"items"`
+	Next  string     `json:"next"`
+}
+
+// Playlist is a playlist object as returned by /me/playlists or, with
+// Followers set, by /playlists/{id}.
+type Playlist struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	Public        *bool  `json:"public"`
+	Collaborative bool   `json:"collaborative"`
+	SnapshotID    string `json:"snapshot_id"`
+	Owner         struct {
+		DisplayName string `json:"display_name"`
+		ID          string `json:"id"`
+	} `json:"owner"`
+	Tracks struct {
+		Total int `json:"total"`
+	} `json:"tracks"`
+	Images    []Image `json:"images"`
+	Followers *struct {
+		Total int `json:"total"`
+	} `json:"followers,omitempty"`
+}
+
+// Image is a playlist cover in one of the sizes Spotify provides.
+type Image struct {
+	URL    string `json:"url"`
+	Height int    `json:"height,omitempty"`
+	Width  int    `json:"width,omitempty"`
+}
+
+// LargestImage picks the biggest image by pixel area. Spotify omits the
+// dimensions for some user-uploaded covers, in which case the first one wins.
+func LargestImage(images []Image) (Image, bool) {
+	best := -1
+	for i, img := range images {
+		if img.URL == "" {
+			continue
+		}
+		if best < 0 || img.Width*img.Height > images[best].Width*images[best].Height {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Image{}, false
+	}
+	return images[best], true
+}
+
+type tracksPage struct {
+	Items []TrackItem `json:"items"`
+	Next  string      `json:"next"`
+}
+
+// TrackItem is a playlist track object: the track plus who added it and when.
+type TrackItem struct {
+	AddedAt string `json:"added_at"`
+	AddedBy struct {
+		ID string `json:"id"`
+	} `json:"added_by"`
+	IsLocal bool  `json:"is_local"`
+	Track   Track `json:"track"`
+}
+
+// Track is a full track object with the identifiers needed to rematch it,
+// such as ExternalIDs["isrc"].
+type Track struct {
+	ID           string            `json:"id"`
+	URI          string            `json:"uri"`
+	Name         string            `json:"name"`
+	DurationMs   int               `json:"duration_ms"`
+	Popularity   int               `json:"popularity"`
+	Explicit     bool              `json:"explicit"`
+	PreviewURL   string            `json:"preview_url"`
+	TrackNumber  int               `json:"track_number"`
+	DiscNumber   int               `json:"disc_number"`
+	IsLocal      bool              `json:"is_local"`
+	ExternalURLs map[string]string `json:"external_urls"`
+	ExternalIDs  map[string]string `json:"external_ids"`
+	Artists      []Artist          `json:"artists"`
+	Album        Album             `json:"album"`
+}
+
+// Artist is a simplified artist object.
+type Artist struct {
+	ID   string `json:"id"`
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+// Album is a simplified album object.
+type Album struct {
+	ID                   string   `json:"id"`
+	URI                  string   `json:"uri"`
+	Name                 string   `json:"name"`
+	AlbumType            string   `json:"album_type"`
+	ReleaseDate          string   `json:"release_date"`
+	ReleaseDatePrecision string   `json:"release_date_precision"`
+	TotalTracks          int      `json:"total_tracks"`
+	Artists              []Artist `json:"artists"`
+}
+
+// ParsePlaylistRef extracts the playlist ID from an open.spotify.com URL, a
+// spotify:playlist: URI or a bare ID.
+func ParsePlaylistRef(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	id := ref
+	switch {
+	case strings.HasPrefix(ref, "spotify:"):
+		parts := strings.Split(ref, ":")
+		if len(parts) < 3 || parts[len(parts)-2] != "playlist" {
+			return "", fmt.Errorf("not a playlist URI: %q", ref)
+		}
+		id = parts[len(parts)-1]
+	case strings.Contains(ref, "://"):
+		u, err := url.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid playlist URL %q: %w", ref, err)
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 2 || parts[len(parts)-2] != "playlist" {
+			return "", fmt.Errorf("not a playlist URL: %q", ref)
+		}
+		id = parts[len(parts)-1]
+	}
+	if !playlistIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid playlist ID %q", ref)
+	}
+	return id, nil
+}
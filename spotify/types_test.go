@@ -0,0 +1,35 @@
+package spotify
+
+import "testing"
+
+func TestParsePlaylistRef(t *testing.T) {
+	const id = "37i9dQZF1DXcBWIGoYBM5M"
+	tests := []struct {
+		name, ref string
+		wantErr   bool
+	}{
+		{name: "URL with si", ref: "https://open.spotify.com/playlist/" + id + "?si=a1b2c3d4e5f64789"},
+		{name: "localized URL", ref: "https://open.spotify.com/intl-de/playlist/" + id},
+		{name: "URI", ref: "spotify:playlist:" + id},
+		{name: "user URI", ref: "spotify:user:alice:playlist:" + id},
+		{name: "bare ID", ref: " " + id + "\n"},
+		{name: "album URL", ref: "https://open.spotify.com/album/" + id, wantErr: true},
+		{name: "track URI", ref: "spotify:track:" + id, wantErr: true},
+		{name: "invalid ID", ref: "not-a-playlist", wantErr: true},
+		{name: "empty", ref: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePlaylistRef(tc.ref)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParsePlaylistRef(%q) = %q, want an error", tc.ref, got)
+				}
+				return
+			}
+			if err != nil || got != id {
+				t.Errorf("ParsePlaylistRef(%q) = %q, %v, want %q", tc.ref, got, err, id)
+			}
+		})
+	}
+}
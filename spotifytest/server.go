@@ -0,0 +1,504 @@
+// Package spotifytest provides an in-process fake of the Spotify Web API and
+// accounts service for end-to-end tests of spotify-backup.
+//
+// Point the tool at Server.APIURL and Server.AccountsURL (SPOTIFY_API_URL and
+// SPOTIFY_ACCOUNTS_URL), or use Server.SpotifyClient, and it will
+// authenticate, page through playlists and tracks and download cover images
+// without touching the network.
+package spotifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"spotify-backup/spotify"
+)
+
+// Fixture is the account data served by a Server.
+type Fixture struct {
+	User      User       `json:"user"`
+	Playlists []Playlist `json:"playlists"`
+	// Public holds playlists that can be fetched by ID but are not part of
+	// the user's library.
+	Public []Playlist `json:"public,omitempty"`
+	// Images maps a path under /images/ to the bytes served for it.
+	Images map[string]string `json:"images,omitempty"`
+}
+
+// User is the profile returned by /v1/me.
+type User struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+// Playlist is a playlist together with its track items. Tracks are kept as
+// raw playlist track objects so fixtures can carry any field the API returns.
+type Playlist struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Description   string            `json:"description"`
+	Public        *bool             `json:"public"`
+	Collaborative bool              `json:"collaborative"`
+	SnapshotID    string            `json:"snapshot_id"`
+	Owner         User              `json:"owner"`
+	Followers     int               `json:"followers"`
+	Images        []Image           `json:"images"`
+	Tracks        []json.RawMessage `json:"tracks"`
+}
+
+// Image is a playlist cover. A URL starting with "/" is resolved against the
+// server, so fixtures can reference images it hosts.
+type Image struct {
+	URL    string `json:"url"`
+	Height int    `json:"height,omitempty"`
+	Width  int    `json:"width,omitempty"`
+}
+
+// LoadFixture reads a Fixture from a JSON file.
+func LoadFixture(path string) (*Fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f Fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("decode fixture %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// Server is a fake Spotify backend. Its exported fields may be changed
+// before the first request.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	AccessToken  string // token accepted by the API and issued by the token endpoint
+	RefreshToken string
+	Scope        string
+	PageSize     int // items per page for playlists and tracks
+	// OnRequest, if set, is called before each request is served, e.g. to
+	// cancel a backup at a known point.
+	OnRequest func(r *http.Request)
+
+	mu       sync.Mutex
+	fixture  *Fixture
+	codes    map[string]string // redirect URI by authorization code
+	issued   int
+	created  int
+	faults   []*fault
+	requests []string
+}
+
+type fault struct {
+	prefix     string
+	status     int
+	remaining  int
+	retryAfter string
+}
+
+// NewServer starts a fake serving f. Call Close when done.
+func NewServer(f *Fixture) *Server {
+	s := &Server{
+		ClientID:     "test-client",
+		ClientSecret: "test-secret",
+		AccessToken:  "test-access-token",
+		RefreshToken: "test-refresh-token",
+		Scope:        "playlist-read-private playlist-read-collaborative user-library-read",
+		PageSize:     2,
+		fixture:      f,
+		codes:        make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /authorize", s.handleAuthorize)
+	mux.HandleFunc("POST /api/token", s.handleToken)
+	mux.HandleFunc("GET /v1/me", s.authorized(s.handleMe))
+	mux.HandleFunc("GET /v1/me/playlists", s.authorized(s.handleMyPlaylists))
+	mux.HandleFunc("GET /v1/playlists/{id}", s.authorized(s.handlePlaylist))
+	mux.HandleFunc("GET /v1/playlists/{id}/tracks", s.authorized(s.handleTracks))
+	mux.HandleFunc("POST /v1/playlists/{id}/tracks", s.authorized(s.handleAddTracks))
+	mux.HandleFunc("PUT /v1/playlists/{id}/followers", s.authorized(s.handleFollow))
+	mux.HandleFunc("POST /v1/users/{id}/playlists", s.authorized(s.handleCreatePlaylist))
+	mux.HandleFunc("GET /images/{name}", s.handleImage)
+	s.Server = httptest.NewServer(s.inject(mux))
+	return s
+}
+
+// APIURL is the value for SPOTIFY_API_URL.
+func (s *Server) APIURL() string { return s.URL + "/v1" }
+
+// AccountsURL is the value for SPOTIFY_ACCOUNTS_URL.
+func (s *Server) AccountsURL() string { return s.URL }
+
+// SpotifyClient returns a client that talks to this server.
+func (s *Server) SpotifyClient() *spotify.Client {
+	c := spotify.NewClient()
+	c.APIBaseURL = s.APIURL()
+	c.AccountsBaseURL = s.AccountsURL()
+	c.HTTPClient = s.Client()
+	return c
+}
+
+// FailNext makes the next n requests whose path, followed by the query if
+// any, starts with prefix fail with status. A 429 is sent with
+// "Retry-After: 0" so retries don't slow tests.
+func (s *Server) FailNext(prefix string, status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &fault{prefix: prefix, status: status, remaining: n}
+	if status == http.StatusTooManyRequests {
+		f.retryAfter = "0"
+	}
+	s.faults = append(s.faults, f)
+}
+
+// Update changes the served fixture, e.g. to remove a playlist from the
+// library between runs.
+func (s *Server) Update(f func(*Fixture)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.fixture)
+}
+
+// Requests returns the method and path of every request served so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// inject records requests and applies faults registered with FailNext.
+func (s *Server) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		var hit *fault
+		target := r.URL.Path
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		for _, f := range s.faults {
+			if f.remaining > 0 && strings.HasPrefix(target, f.prefix) {
+				f.remaining--
+				hit = f
+				break
+			}
+		}
+		onRequest := s.OnRequest
+		s.mu.Unlock()
+
+		if onRequest != nil {
+			onRequest(r)
+		}
+		if hit != nil {
+			if hit.retryAfter != "" {
+				w.Header().Set("Retry-After", hit.retryAfter)
+			}
+			writeError(w, hit.status, http.StatusText(hit.status))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized rejects API calls that don't carry the current access token.
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		want := "Bearer " + s.AccessToken
+		s.mu.Unlock()
+		if r.Header.Get("Authorization") != want {
+			writeError(w, http.StatusUnauthorized, "Invalid access token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAuthorize approves every request and redirects back with a code.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != s.ClientID || redirect.String() == "" {
+		writeError(w, http.StatusBadRequest, "invalid authorize request")
+		return
+	}
+	s.mu.Lock()
+	s.issued++
+	code := fmt.Sprintf("code-%d", s.issued)
+	s.codes[code] = q.Get("redirect_uri")
+	s.mu.Unlock()
+
+	v := redirect.Query()
+	v.Set("code", code)
+	if state := q.Get("state"); state != "" {
+		v.Set("state", state)
+	}
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != s.ClientID || secret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := map[string]any{
+		"access_token": s.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		// like Spotify, the redirect URI of the authorization is required
+		if uri, ok := s.codes[code]; !ok || uri != r.PostForm.Get("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(s.codes, code)
+		resp["refresh_token"] = s.RefreshToken
+		resp["scope"] = s.Scope
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != s.RefreshToken {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		resp["scope"] = s.Scope
+	case "client_credentials":
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.fixture.User)
+}
+
+func (s *Server) handleMyPlaylists(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]any, len(s.fixture.Playlists))
+	for i := range s.fixture.Playlists {
+		items[i] = s.playlistObject(&s.fixture.Playlists[i], false)
+	}
+	s.writePage(w, r, items)
+}
+
+func (s *Server) handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.findPlaylist(r.PathValue("id"))
+	if p == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.playlistObject(p, true))
+}
+
+func (s *Server) handleTracks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.findPlaylist(r.PathValue("id"))
+	if p == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	items := make([]any, len(p.Tracks))
+	for i, t := range p.Tracks {
+		items[i] = t
+	}
+	s.writePage(w, r, items)
+}
+
+// handleFollow moves a playlist from Public into the user's library.
+func (s *Server) handleFollow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	for i, p := range s.fixture.Public {
+		if p.ID == id {
+			s.fixture.Playlists = append(s.fixture.Playlists, p)
+			s.fixture.Public = append(s.fixture.Public[:i], s.fixture.Public[i+1:]...)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	if s.findPlaylist(id) == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleCreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name          string `json:"name"`
+		Description   string `json:"description"`
+		Public        *bool  `json:"public"`
+		Collaborative bool   `json:"collaborative"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+		writeError(w, http.StatusBadRequest, "Missing required field: name")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.PathValue("id") != s.fixture.User.ID {
+		writeError(w, http.StatusForbidden, "You cannot create a playlist for another user")
+		return
+	}
+	if body.Public == nil {
+		public := true
+		body.Public = &public
+	}
+	s.created++
+	s.fixture.Playlists = append(s.fixture.Playlists, Playlist{
+		ID:            fmt.Sprintf("created%d", s.created),
+		Name:          body.Name,
+		Description:   body.Description,
+		Public:        body.Public,
+		Collaborative: body.Collaborative,
+		SnapshotID:    "snap",
+		Owner:         s.fixture.User,
+	})
+	writeJSON(w, http.StatusCreated, s.playlistObject(&s.fixture.Playlists[len(s.fixture.Playlists)-1], true))
+}
+
+func (s *Server) handleAddTracks(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URIs []string `json:"uris"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.URIs) == 0 {
+		writeError(w, http.StatusBadRequest, "No uris provided")
+		return
+	}
+	if len(body.URIs) > 100 {
+		writeError(w, http.StatusBadRequest, "You can add a maximum of 100 tracks per request")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.findPlaylist(r.PathValue("id"))
+	if p == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	if p.Owner.ID != s.fixture.User.ID && !p.Collaborative {
+		writeError(w, http.StatusForbidden, "You cannot add tracks to a playlist you don't own")
+		return
+	}
+	for _, uri := range body.URIs {
+		item, _ := json.Marshal(map[string]any{"track": map[string]string{"uri": uri}})
+		p.Tracks = append(p.Tracks, item)
+	}
+	p.SnapshotID += "+"
+	writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": p.SnapshotID})
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.fixture.Images[r.PathValue("name")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write([]byte(data))
+}
+
+func (s *Server) findPlaylist(id string) *Playlist {
+	for _, list := range [][]Playlist{s.fixture.Playlists, s.fixture.Public} {
+		for i := range list {
+			if list[i].ID == id {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// playlistObject renders p the way the API does: the simplified object in
+// listings and the full object, with followers, when fetched by ID.
+func (s *Server) playlistObject(p *Playlist, full bool) map[string]any {
+	images := make([]Image, len(p.Images))
+	for i, img := range p.Images {
+		if strings.HasPrefix(img.URL, "/") {
+			img.URL = s.URL + img.URL
+		}
+		images[i] = img
+	}
+	obj := map[string]any{
+		"id":            p.ID,
+		"name":          p.Name,
+		"description":   p.Description,
+		"public":        p.Public,
+		"collaborative": p.Collaborative,
+		"snapshot_id":   p.SnapshotID,
+		"owner":         p.Owner,
+		"images":        images,
+		"tracks":        map[string]int{"total": len(p.Tracks)},
+		"uri":           "spotify:playlist:" + p.ID,
+	}
+	if full {
+		obj["followers"] = map[string]any{"total": p.Followers}
+	}
+	return obj
+}
+
+// writePage serves one page of items using the limit and offset parameters,
+// linking to the next page with an absolute URL like the real API.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []any) {
+	q := r.URL.Query()
+	limit := s.PageSize
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	offset = max(0, min(offset, len(items)))
+	end := min(offset+limit, len(items))
+
+	var next any
+	if end < len(items) {
+		q.Set("offset", strconv.Itoa(end))
+		q.Set("limit", strconv.Itoa(limit))
+		next = s.URL + r.URL.Path + "?" + q.Encode()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"items":  items[offset:end],
+		"limit":  limit,
+		"offset": offset,
+		"total":  len(items),
+		"next":   next,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError mimics the Web API error body.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{"status": status, "message": message},
+	})
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Names of the files written by importing Spotify's account data export,
+// inside HistoryDir of the backup directory.
+const (
+	HistoryDir  = "history"
+	HistoryFile = "streaming-history.json"
+	LibraryFile = "library.json"
+)
+
+// HistorySchemaVersion is written into the history and library files.
+const HistorySchemaVersion = 1
+
+// Sources of a Play, the part of the account data export it came from.
+const (
+	SourceAccountData = "account_data" // StreamingHistory*.json, the last year
+	SourceExtended    = "extended"     // extended streaming history, the whole lifetime
+)
+
+// Play is one stream from the listening history, normalized from the
+// formats of the account data export. Music has Track, Artist and Album,
+// podcasts Episode and Show.
+type Play struct {
+	PlayedAt    time.Time `json:"played_at"` // when playback stopped, UTC
+	MsPlayed    int       `json:"ms_played"`
+	Track       string    `json:"track,omitempty"`
+	Artist      string    `json:"artist,omitempty"`
+	Album       string    `json:"album,omitempty"`
+	TrackURI    string    `json:"track_uri,omitempty"`
+	Episode     string    `json:"episode,omitempty"`
+	Show        string    `json:"show,omitempty"`
+	EpisodeURI  string    `json:"episode_uri,omitempty"`
+	Platform    string    `json:"platform,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	ReasonStart string    `json:"reason_start,omitempty"`
+	ReasonEnd   string    `json:"reason_end,omitempty"`
+	Shuffle     *bool     `json:"shuffle,omitempty"`
+	Skipped     *bool     `json:"skipped,omitempty"`
+	Offline     *bool     `json:"offline,omitempty"`
+	Source      string    `json:"source"`
+}
+
+// History is the content of the history file, plays sorted by PlayedAt.
+type History struct {
+	SchemaVersion int       `json:"schema_version"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Plays         []Play    `json:"plays"`
+}
+
+// Library is the content of the library file, the saved items listed in
+// YourLibrary.json when the data was exported.
+type Library struct {
+	SchemaVersion int              `json:"schema_version"`
+	ImportedAt    time.Time        `json:"imported_at"`
+	Tracks        []LibraryItem    `json:"tracks"`
+	Albums        []LibraryItem    `json:"albums"`
+	Artists       []LibraryItem    `json:"artists"`
+	Shows         []LibraryItem    `json:"shows"`
+	Episodes      []LibraryItem    `json:"episodes"`
+	BannedTracks  []LibraryItem    `json:"banned_tracks,omitempty"`
+	BannedArtists []LibraryItem    `json:"banned_artists,omitempty"`
+	Other         []map[string]any `json:"other,omitempty"` // kept as exported
+}
+
+// LibraryItem is a saved track, album, artist, show or episode; only the
+// fields that apply are set.
+type LibraryItem struct {
+	Name      string `json:"name,omitempty"` // of the track, album, artist, show or episode
+	Artist    string `json:"artist,omitempty"`
+	Album     string `json:"album,omitempty"`
+	Show      string `json:"show,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	URI       string `json:"uri,omitempty"`
+}
+
+// ReadHistory loads the history file from a backup directory.
+func ReadHistory(dir string) (*History, error) {
+	path := filepath.Join(dir, HistoryDir, HistoryFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var h History
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if h.SchemaVersion > HistorySchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d", path, h.SchemaVersion)
+	}
+	return &h, nil
+}
+
+// ReadLibrary loads the library file from a backup directory.
+func ReadLibrary(dir string) (*Library, error) {
+	path := filepath.Join(dir, HistoryDir, LibraryFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Library
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if l.SchemaVersion > HistorySchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d", path, l.SchemaVersion)
+	}
+	return &l, nil
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestFile lists every file of a backup with its size and checksum.
+const ManifestFile = "manifest.json"
+
+// Manifest describes the state of a backup directory after a run.
+type Manifest struct {
+	ToolVersion    string          `json:"tool_version"`
+	SchemaVersion  int             `json:"schema_version"`
+	StartedAt      time.Time       `json:"started_at"`
+	FinishedAt     time.Time       `json:"finished_at"`
+	Complete       bool            `json:"complete"`
+	Playlists      int             `json:"playlists"`
+	TracksExpected int             `json:"tracks_expected"` // sum of tracks_total
+	TracksSaved    int             `json:"tracks_saved"`    // sum of saved track items
+	PlaylistCounts []PlaylistCount `json:"playlist_counts"`
+	Files          []ManifestEntry `json:"files"`
+}
+
+// PlaylistCount compares the track count Spotify reported for a playlist
+// with the number of items actually saved.
+type PlaylistCount struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	TracksTotal int    `json:"tracks_total"`
+	Tracks      int    `json:"tracks"`
+}
+
+// Mismatch reports whether fewer or more tracks were saved than expected.
+func (c PlaylistCount) Mismatch() bool {
+	return c.TracksTotal != c.Tracks
+}
+
+// ManifestEntry is one file of the backup; Path is relative to the backup
+// directory and uses forward slashes.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BuildManifest hashes every file in dir and counts the tracks of the
+// playlists in index. The manifest itself, the run report, the journal, the
+// incomplete marker and leftover .tmp files are not listed. Metadata such as
+// the tool version and timestamps is left for the caller to fill in.
+func BuildManifest(dir string, index []IndexEntry) (*Manifest, error) {
+	m := &Manifest{SchemaVersion: SchemaVersion, Playlists: len(index)}
+	for _, e := range index {
+		sp, err := ReadSavedPlaylist(filepath.Join(dir, e.File))
+		if err != nil {
+			return nil, err
+		}
+		c := PlaylistCount{ID: e.ID, Name: e.Name, File: e.File, TracksTotal: sp.TracksTotal, Tracks: len(sp.Tracks)}
+		m.PlaylistCounts = append(m.PlaylistCounts, c)
+		m.TracksExpected += c.TracksTotal
+		m.TracksSaved += c.Tracks
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == JournalDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !manifested(rel) {
+			return nil
+		}
+		size, sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestEntry{Path: rel, Size: size, SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m, nil
+}
+
+// manifested reports whether a file belongs in the manifest.
+func manifested(rel string) bool {
+	switch rel {
+	case ManifestFile, ReportFile, IncompleteFile:
+		return false
+	}
+	return !strings.HasSuffix(rel, ".tmp")
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadManifest loads manifest.json from a backup directory.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", ManifestFile, err)
+	}
+	return &m, nil
+}
+
+// Kinds of problems reported by Verify.
+const (
+	ProblemMissing   = "missing"
+	ProblemTruncated = "truncated" // smaller than recorded
+	ProblemModified  = "modified"  // same size or larger, different checksum
+)
+
+// Problem is a file that doesn't match its manifest entry.
+type Problem struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s (%s)", p.Kind, p.Path, p.Detail)
+}
+
+// Verify re-hashes the files listed in m and returns those that are missing
+// or differ. Files added since the manifest was written are not reported.
+func Verify(dir string, m *Manifest) ([]Problem, error) {
+	var problems []Problem
+	for _, e := range m.Files {
+		size, sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			problems = append(problems, Problem{Path: e.Path, Kind: ProblemMissing, Detail: "file not found"})
+		case err != nil:
+			return nil, err
+		case size < e.Size:
+			problems = append(problems, Problem{Path: e.Path, Kind: ProblemTruncated, Detail: fmt.Sprintf("%d of %d bytes", size, e.Size)})
+		case sum != e.SHA256:
+			problems = append(problems, Problem{Path: e.Path, Kind: ProblemModified, Detail: "sha256 " + sum})
+		}
+	}
+	return problems, nil
+}
+
+// UpdateManifest hashes the files at paths, relative to dir, again and
+// records them in the manifest of dir, so Verify doesn't report files
+// written outside of a backup run as modified. Without a manifest it does
+// nothing; the next run lists the files.
+func UpdateManifest(dir string, paths []string) error {
+	m, err := ReadManifest(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, rel := range paths {
+		rel = filepath.ToSlash(rel)
+		size, sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{Path: rel, Size: size, SHA256: sum}
+		i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Path >= rel })
+		if i < len(m.Files) && m.Files[i].Path == rel {
+			m.Files[i] = e
+		} else {
+			m.Files = slices.Insert(m.Files, i, e)
+		}
+	}
+	return WriteJSONFile(filepath.Join(dir, ManifestFile), m)
+}
@@ -0,0 +1,151 @@
+// Package storage defines the on-disk layout of a backup: the playlist
+// files, the cover images and the top-level playlists-index.json.
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"spotify-backup/spotify"
+)
+
+// SchemaVersion is written into every playlist file. Files written before
+// the field existed decode with version 0 and are treated as v1.
+const SchemaVersion = 2
+
+// Names of the files and directories inside a backup directory.
+const (
+	IndexFile      = "playlists-index.json"
+	IncompleteFile = "INCOMPLETE" // present while the index is partial
+	PlaylistsDir   = "playlists"
+	ImagesDir      = "images"
+	JournalDir     = ".journal"      // checkpoints of an unfinished run
+	JournalFile    = "journal.jsonl" // inside JournalDir
+	ReportFile     = "report.json"   // failures and warnings of the last run
+)
+
+var sanitizePattern = regexp.MustCompile(`[^\w\-. ]+`)
+
+// IndexEntry is one line of playlists-index.json.
+type IndexEntry struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	ImageFile string `json:"imageFile,omitempty"`
+	Followed  bool   `json:"followed,omitempty"`
+}
+
+// Incomplete is written to IncompleteFile when a run stops early, next to
+// the partial index it describes.
+type Incomplete struct {
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+	Selected  int       `json:"selected"`  // playlists the run meant to back up
+	Processed int       `json:"processed"` // playlists handled before stopping
+}
+
+// SavedPlaylist is the content of a playlist file.
+type SavedPlaylist struct {
+	SchemaVersion int                 `json:"schema_version"`
+	ID            string              `json:"id"`
+	Name          string              `json:"name"`
+	Description   string              `json:"description"`
+	Owner         string              `json:"owner"`
+	OwnerID       string              `json:"owner_id"`
+	Public        *bool               `json:"public"`
+	Collaborative bool                `json:"collaborative"`
+	Followers     int                 `json:"followers"`
+	SnapshotID    string              `json:"snapshot_id"`
+	Image         string              `json:"image,omitempty"`
+	Images        []spotify.Image     `json:"images,omitempty"`
+	TracksTotal   int                 `json:"tracks_total"`
+	Tracks        []spotify.TrackItem `json:"tracks"`
+	SourceURL     string              `json:"source_url"`
+}
+
+// WriteJSONFile writes v as indented JSON, replacing path atomically.
+func WriteJSONFile(path string, v interface{}) error {
+	return WriteJSONFilePerm(path, v, 0o666)
+}
+
+// WriteJSONFilePerm is WriteJSONFile creating the file with perm (before
+// umask), e.g. 0600 for files holding secrets.
+func WriteJSONFilePerm(path string, v interface{}, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadSavedPlaylist loads a playlist file written by any version of the tool.
+func ReadSavedPlaylist(path string) (*SavedPlaylist, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sp SavedPlaylist
+	if err := json.Unmarshal(b, &sp); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if sp.SchemaVersion == 0 {
+		sp.SchemaVersion = 1
+	}
+	if sp.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d", path, sp.SchemaVersion)
+	}
+	return &sp, nil
+}
+
+// ReadIndex loads playlists-index.json from a backup directory.
+func ReadIndex(dir string) ([]IndexEntry, error) {
+	b, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index []IndexEntry
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", IndexFile, err)
+	}
+	return index, nil
+}
+
+// SafeFilename strips characters that are unsafe in file names.
+func SafeFilename(name string) string {
+	name = strings.TrimSpace(name)
+	name = sanitizePattern.ReplaceAllString(name, "_")
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	return name
+}
+
+// ImageExt guesses a file extension from an image URL, defaulting to .jpg
+// since Spotify's CDN URLs usually have none.
+func ImageExt(urlStr string) string {
+	u, _ := url.Parse(urlStr)
+	if u != nil {
+		if ext := filepath.Ext(u.Path); ext != "" && len(ext) <= 5 {
+			return ext
+		}
+	}
+	return ".jpg"
+}